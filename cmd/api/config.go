@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// The prefix of the environment variables for the settings. The variable for a setting
+// is the prefix followed by the name of its flag in upper case, with underscores for
+// the hyphens (e.g. GREENLIGHT_DB_DSN for -db-dsn).
+const envPrefix = "GREENLIGHT_"
+
+// The flags which are only command-line options rather than settings: they can't be set
+// in the configuration file or the environment, and aren't printed by -print-config.
+var commandLineOnly = map[string]bool{
+	"config":       true,
+	"print-config": true,
+	"version":      true,
+}
+
+// The settings whose values are masked by -print-config.
+var secretSettings = map[string]bool{
+	"db-dsn":        true,
+	"smtp-password": true,
+	"otel-headers":  true,
+}
+
+// The errInvalidFlags error is returned by loadConfig() when the command-line flags
+// can't be parsed, in which case the flag package has already printed the error and
+// the usage.
+var errInvalidFlags = errors.New("invalid command-line flags")
+
+// The configuration loaded by loadConfig(), along with the flag set it was loaded with
+// (for -print-config) and the command-line options.
+type loadedConfig struct {
+	cfg            config
+	flags          *flag.FlagSet
+	file           string
+	printConfig    bool
+	displayVersion bool
+}
+
+// A value for a setting from the configuration file or the environment, and where it
+// came from (for the error messages). Lists in the configuration file have several
+// values, which are each passed to the flag's Set() method.
+type setting struct {
+	values []string
+	source string
+}
+
+// Defines the flags for all the settings, which store their values in cfg.
+func defineConfigFlags(fs *flag.FlagSet, cfg *config) {
+	// Read the value of the port and env command-line flags into the config struct.
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	fs.TextVar(&cfg.log.level, "log-level", jsonlog.LevelInfo, "Minimum log level (debug|info|warn|error|fatal|off)")
+	fs.BoolVar(&cfg.log.stdout.enabled, "log-stdout", true, "Write the log to standard out")
+	fs.TextVar(&cfg.log.stdout.level, "log-stdout-level", jsonlog.LevelDebug, "Minimum log level for standard out")
+	fs.StringVar(&cfg.log.file.path, "log-file", "", "Also write the log to this file (disabled if empty)")
+	fs.TextVar(&cfg.log.file.level, "log-file-level", jsonlog.LevelDebug, "Minimum log level for the log file")
+	fs.IntVar(&cfg.log.file.maxSize, "log-file-max-size", 100, "Rotate the log file once it reaches this size in megabytes (0 = no limit)")
+	fs.DurationVar(&cfg.log.file.maxAge, "log-file-max-age", 24*time.Hour, "Rotate the log file once it has been written to for this long (0 = no limit)")
+	fs.IntVar(&cfg.log.file.maxBackups, "log-file-max-backups", 7, "Number of rotated log files to keep (0 = no limit)")
+	fs.DurationVar(&cfg.log.file.retention, "log-file-retention", 30*24*time.Hour, "Remove rotated log files older than this (0 = no limit)")
+	fs.BoolVar(&cfg.log.syslog.enabled, "log-syslog", false, "Also send the log to the local syslog daemon")
+	fs.TextVar(&cfg.log.syslog.level, "log-syslog-level", jsonlog.LevelWarn, "Minimum log level for syslog")
+	fs.StringVar(&cfg.log.syslog.tag, "log-syslog-tag", "greenlight", "Tag for the syslog messages")
+	fs.TextVar(&cfg.log.stackTraces, "log-stack-traces", jsonlog.StackTracesErrors, "Which log entries include a stack trace (errors|fatal|off)")
+	fs.BoolVar(&cfg.log.redact, "log-redact", true, "Redact sensitive data (passwords, tokens, email addresses...) from the log (default false with -env=development, so that the emails of the log mailer transport can be read)")
+	fs.Var(stringList{&cfg.log.redactKeys}, "log-redact-keys", "Additional property keys to redact from the log (space separated)")
+	fs.Var(regexpList{&cfg.log.redactPatterns}, "log-redact-patterns", "Additional regular expression to redact from the log (may be repeated)")
+	// Read the DSN value from the db-dsn command-line flag into the config struct. Like
+	// every setting, it can also be set with an environment variable, in this case
+	// GREENLIGHT_DB_DSN (see loadConfig()).
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+
+	// Rate limiting
+
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.Float64Var(&cfg.limiter.suggest.rps, "limiter-suggest-rps", 1, "Rate limiter maximum requests per second for title suggestions (a separate, tighter bucket)")
+	fs.IntVar(&cfg.limiter.suggest.burst, "limiter-suggest-burst", 3, "Rate limiter maximum burst for title suggestions")
+
+	// Read the mailer configuration settings into the config struct. By default emails
+	// are written to the log, so that no SMTP server is needed during development.
+	fs.StringVar(&cfg.mailer.transport, "mailer-transport", "log", "Mailer transport (smtp|file|log); the log transport writes the emails to the log, so their tokens are redacted unless -log-redact=false")
+	fs.StringVar(&cfg.mailer.sender, "mailer-sender", "Greenlight <no-reply@greenlight.mazavrbazavr.ru>", "Email sender")
+	fs.StringVar(&cfg.mailer.dir, "mailer-dir", "tmp/mail", "Directory to write .eml files to for the file mailer transport")
+
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+
+	fs.Var(stringList{&cfg.cors.trustedOrigins}, "cors-trusted-origins", "Trusted CORS origins (space separated)")
+
+	fs.IntVar(&cfg.jobs.workers, "jobs-workers", 2, "Number of background job workers")
+	fs.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", time.Second, "How often idle job workers check for new jobs")
+
+	fs.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", 5*time.Second, "How often the outbox worker checks for emails to send")
+	fs.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 10, "Number of attempts to deliver an email before giving up")
+
+	fs.DurationVar(&cfg.webhooks.pollInterval, "webhooks-poll-interval", time.Second, "How often the webhook worker checks for deliveries to make")
+	fs.IntVar(&cfg.webhooks.maxAttempts, "webhooks-max-attempts", 8, "Number of attempts to make a webhook delivery before giving up")
+	fs.DurationVar(&cfg.webhooks.timeout, "webhooks-timeout", 10*time.Second, "Timeout for each webhook delivery")
+
+	fs.BoolVar(&cfg.health.checkSMTP, "health-check-smtp", false, "Check that the SMTP server is reachable in the readiness check")
+	fs.DurationVar(&cfg.health.maxJobLag, "health-max-job-lag", 5*time.Minute, "Job queue lag above which the readiness check warns")
+	fs.DurationVar(&cfg.health.shutdownDelay, "health-shutdown-delay", 5*time.Second, "How long to report not ready before shutting down")
+
+	fs.StringVar(&cfg.otel.endpoint, "otel-endpoint", "", "OTLP/HTTP endpoint to send traces to, e.g. http://localhost:4318 (tracing is disabled if empty)")
+	fs.Var(headerMap{&cfg.otel.headers}, "otel-headers", "Extra headers for the OTLP requests (comma separated key=value pairs)")
+	fs.StringVar(&cfg.otel.serviceName, "otel-service-name", "greenlight", "Service name for the traces")
+	fs.Float64Var(&cfg.otel.sampleRatio, "otel-sample-ratio", 1, "Ratio of new traces to sample (0 to 1)")
+
+}
+
+// Loads the configuration from several layers, each of which overrides the one before:
+//
+//  1. the defaults of the flags;
+//  2. the configuration file, given by -config or GREENLIGHT_CONFIG;
+//  3. the GREENLIGHT_* environment variables;
+//  4. the command-line flags.
+//
+// Any setting can also be read from a file, for secrets mounted by an orchestrator:
+// GREENLIGHT_SMTP_PASSWORD_FILE=/run/secrets/smtp in the environment, or
+// password_file = "/run/secrets/smtp" in the [smtp] section of the configuration file.
+// A name ending in _FILE (or _file) is only taken to be the path of such a file when it
+// isn't a setting itself: the file key of the [log] section is the -log-file setting,
+// while file_file would give a file to read it from. No setting's flag is another's
+// with "-file" added (see TestConfigFileSuffix), so a name can't mean both.
+//
+// The configuration file is a subset of TOML: "key = value" lines, where the values are
+// quoted strings, numbers, booleans or one-line arrays, grouped under [section]
+// headers. The name of a setting's flag is its section and key joined with a hyphen,
+// with hyphens for the underscores (so "max_open_conns" in the [db] section is
+// -db-max-open-conns). Unknown settings are an error, so typos don't go unnoticed.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*loadedConfig, error) {
+	l := &loadedConfig{}
+
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	defineConfigFlags(fs, &l.cfg)
+	fs.StringVar(&l.file, "config", "", "Path to a TOML configuration file (or $GREENLIGHT_CONFIG)")
+	fs.BoolVar(&l.printConfig, "print-config", false, "Print the effective configuration, with the secrets masked, and exit")
+	fs.BoolVar(&l.displayVersion, "version", false, "Display version and exit")
+
+	l.flags = fs
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidFlags, err)
+	}
+
+	// The settings given on the command line take precedence over everything else, so
+	// note which they are.
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if l.file == "" {
+		l.file, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+
+	settings := make(map[string]setting)
+
+	if l.file != "" {
+		settings, err = readConfigFile(fs, l.file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The environment variables override the configuration file.
+	var envErr error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if commandLineOnly[f.Name] || envErr != nil {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		value, found := lookupEnv(name)
+		path, foundFile := lookupEnv(name + "_FILE")
+
+		switch {
+		case found && foundFile:
+			envErr = fmt.Errorf("%s and %s_FILE are both set", name, name)
+		case found:
+			settings[f.Name] = setting{values: []string{value}, source: name}
+		case foundFile:
+			value, err := readSecretFile(path)
+			if err != nil {
+				envErr = fmt.Errorf("%s_FILE: %w", name, err)
+				return
+			}
+			settings[f.Name] = setting{values: []string{value}, source: name + "_FILE"}
+		}
+	})
+
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	// Apply the settings, in order of name so that the errors are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		if explicit[name] {
+			continue
+		}
+
+		for _, value := range settings[name].values {
+			err := fs.Set(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid value for -%s: %w", settings[name].source, name, err)
+			}
+		}
+	}
+
+	// In development, the emails sent with the log mailer transport (activation tokens
+	// and all) are read from the log, so redaction is off unless it has been set.
+	if _, set := settings["log-redact"]; l.cfg.env == "development" && !set && !explicit["log-redact"] {
+		fs.Set("log-redact", "false")
+	}
+
+	return l, nil
+}
+
+// Reads the settings from the configuration file.
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]setting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	settings := make(map[string]setting)
+	section := ""
+
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		source := fmt.Sprintf("%s:%d", path, n)
+
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s: invalid section header", source)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, raw, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s: expected key = value", source)
+		}
+
+		key = strings.TrimSpace(key)
+		if section != "" {
+			key = section + "." + key
+		}
+
+		values, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+
+		name := strings.NewReplacer("_", "-", ".", "-").Replace(key)
+
+		// A key with a "_file" suffix which isn't a setting itself (unlike the "file" key
+		// in the [log] section) gives the path of a file to read the setting from.
+		if fs.Lookup(name) == nil && strings.HasSuffix(name, "-file") {
+			name = strings.TrimSuffix(name, "-file")
+
+			if len(values) != 1 {
+				return nil, fmt.Errorf("%s: %s must be a single path", source, key)
+			}
+
+			value, err := readSecretFile(values[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+
+			values = []string{value}
+		}
+
+		if fs.Lookup(name) == nil || commandLineOnly[name] {
+			return nil, fmt.Errorf("%s: unknown setting %q", source, key)
+		}
+
+		if previous, ok := settings[name]; ok {
+			return nil, fmt.Errorf("%s: %s is already set at %s", source, key, previous.source)
+		}
+
+		settings[name] = setting{values: values, source: source}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// Removes a comment (from a "#" outside of a string to the end of the line).
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// Parses the value of a setting in the configuration file: a quoted string (in double
+// quotes, with escapes, or single quotes, without), a number, a boolean, or an array
+// of these on one line.
+func parseConfigValue(raw string) ([]string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		value, err := parseConfigScalar(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+
+	if !strings.HasSuffix(raw, "]") {
+		return nil, errors.New("arrays must be on a single line")
+	}
+
+	values := []string{}
+
+	for _, element := range splitArray(raw[1 : len(raw)-1]) {
+		element = strings.TrimSpace(element)
+		if element == "" {
+			continue
+		}
+
+		value, err := parseConfigScalar(element)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+var numberRX = regexp.MustCompile(`^[+-]?[0-9][0-9_]*(\.[0-9_]+)?([eE][+-]?[0-9]+)?$`)
+
+func parseConfigScalar(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	case numberRX.MatchString(raw):
+		return strings.ReplaceAll(raw, "_", ""), nil
+	default:
+		return "", fmt.Errorf("invalid value %s (strings must be quoted)", raw)
+	}
+}
+
+// Splits the elements of an array on the commas outside of strings.
+func splitArray(s string) []string {
+	var elements []string
+	var quote rune
+	escaped := false
+	start := 0
+
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			elements = append(elements, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(elements, s[start:])
+}
+
+// Reads a setting from a file, without the trailing newline that editors (and echo)
+// add.
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Writes the effective configuration, in the format of the configuration file (so it
+// can be used as one), with the values of the secrets masked.
+func (l *loadedConfig) write(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Effective configuration of greenlight %s.\n", version)
+
+	// The settings without a section have to come first. flag.VisitAll() goes through
+	// the flags in order of name, so the settings in each section are together.
+	var sectioned []*flag.Flag
+
+	l.flags.VisitAll(func(f *flag.Flag) {
+		switch {
+		case commandLineOnly[f.Name]:
+		case strings.Contains(f.Name, "-"):
+			sectioned = append(sectioned, f)
+		default:
+			fmt.Fprintf(&b, "%s = %s\n", f.Name, formatConfigValue(f))
+		}
+	})
+
+	section := ""
+
+	for _, f := range sectioned {
+		prefix, key, _ := strings.Cut(f.Name, "-")
+
+		if prefix != section {
+			section = prefix
+			fmt.Fprintf(&b, "\n[%s]\n", section)
+		}
+
+		fmt.Fprintf(&b, "%s = %s\n", strings.ReplaceAll(key, "-", "_"), formatConfigValue(f))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// The text which the values of the secrets are replaced with.
+const masked = "********"
+
+// Formats the value of the flag for the configuration file, masking it if it's a secret.
+func formatConfigValue(f *flag.Flag) string {
+	if secretSettings[f.Name] && f.Value.String() != "" {
+		return strconv.Quote(maskSecret(f.Name, f.Value.String()))
+	}
+
+	var value any = f.Value.String()
+	if getter, ok := f.Value.(flag.Getter); ok {
+		value = getter.Get()
+	}
+
+	switch v := value.(type) {
+	case bool, int, int64, uint, uint64:
+		return fmt.Sprint(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		return strconv.Quote(f.Value.String())
+	}
+}
+
+// Matches the password in a DSN made of key=value pairs, which may be in single quotes
+// (with backslash escapes).
+var dsnPasswordRX = regexp.MustCompile(`(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// Masks the secret parts of a value: the password in a DSN (so the rest of it is still
+// visible), the values of the OTLP headers, and the whole of anything else.
+func maskSecret(name, value string) string {
+	switch name {
+	case "db-dsn":
+		// A DSN is either a URL, with the password in the user info or a password query
+		// parameter, or key=value pairs like "host=localhost password=secret".
+		if !strings.Contains(value, "://") {
+			return dsnPasswordRX.ReplaceAllString(value, "${1}"+masked)
+		}
+
+		u, err := url.Parse(value)
+		if err != nil {
+			return masked
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), masked)
+		}
+		if query := u.Query(); query.Has("password") {
+			query.Set("password", masked)
+			u.RawQuery = query.Encode()
+		}
+		return strings.ReplaceAll(u.String(), url.QueryEscape(masked), masked)
+	case "otel-headers":
+		pairs := strings.Split(value, ",")
+		for i, pair := range pairs {
+			key, _, _ := strings.Cut(pair, "=")
+			pairs[i] = key + "=" + masked
+		}
+		return strings.Join(pairs, ",")
+	default:
+		return masked
+	}
+}
+
+// Checks that the settings are valid, returning a map of the errors keyed by the names
+// of the flags, in the same way as the validation of the API's input.
+func (cfg config) validate() map[string]string {
+	v := validator.New()
+
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+
+	v.Check(cfg.log.stdout.enabled || cfg.log.file.path != "" || cfg.log.syslog.enabled, "log-stdout", "at least one log sink must be enabled")
+	v.Check(cfg.log.file.maxSize >= 0, "log-file-max-size", "must not be negative")
+	v.Check(cfg.log.file.maxAge >= 0, "log-file-max-age", "must not be negative")
+	v.Check(cfg.log.file.maxBackups >= 0, "log-file-max-backups", "must not be negative")
+	v.Check(cfg.log.file.retention >= 0, "log-file-retention", "must not be negative")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns >= 0, "db-max-open-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	maxIdleTime, err := time.ParseDuration(cfg.db.maxIdleTime)
+	v.Check(err == nil && maxIdleTime >= 0, "db-max-idle-time", "must be a duration, like 15m")
+
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+		v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than zero")
+		v.Check(cfg.limiter.suggest.rps > 0, "limiter-suggest-rps", "must be greater than zero")
+		v.Check(cfg.limiter.suggest.burst > 0, "limiter-suggest-burst", "must be greater than zero")
+	}
+
+	v.Check(validator.PermittedValue(cfg.mailer.transport, "smtp", "file", "log"), "mailer-transport", "must be smtp, file or log")
+	_, err = mail.ParseAddress(cfg.mailer.sender)
+	v.Check(err == nil, "mailer-sender", "must be a valid email address")
+
+	switch cfg.mailer.transport {
+	case "smtp":
+		v.Check(cfg.smtp.host != "", "smtp-host", "must be provided")
+		v.Check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+		v.Check(cfg.smtp.password == "" || cfg.smtp.username != "", "smtp-username", "must be provided with a password")
+	case "file":
+		v.Check(cfg.mailer.dir != "", "mailer-dir", "must be provided")
+	}
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		u, err := url.Parse(origin)
+		v.Check(err == nil && u.Scheme != "" && u.Host != "" && u.Path == "", "cors-trusted-origins", fmt.Sprintf("%q is not an origin, like https://example.com", origin))
+	}
+
+	v.Check(cfg.jobs.workers > 0, "jobs-workers", "must be greater than zero")
+	v.Check(cfg.jobs.pollInterval > 0, "jobs-poll-interval", "must be greater than zero")
+	v.Check(cfg.outbox.pollInterval > 0, "outbox-poll-interval", "must be greater than zero")
+	v.Check(cfg.outbox.maxAttempts > 0, "outbox-max-attempts", "must be greater than zero")
+	v.Check(cfg.webhooks.pollInterval > 0, "webhooks-poll-interval", "must be greater than zero")
+	v.Check(cfg.webhooks.maxAttempts > 0, "webhooks-max-attempts", "must be greater than zero")
+	v.Check(cfg.webhooks.timeout > 0, "webhooks-timeout", "must be greater than zero")
+
+	v.Check(cfg.health.maxJobLag > 0, "health-max-job-lag", "must be greater than zero")
+	v.Check(cfg.health.shutdownDelay >= 0, "health-shutdown-delay", "must not be negative")
+
+	if cfg.otel.endpoint != "" {
+		u, err := url.Parse(cfg.otel.endpoint)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "otel-endpoint", "must be an http or https URL")
+	}
+	v.Check(cfg.otel.serviceName != "", "otel-service-name", "must be provided")
+	v.Check(cfg.otel.sampleRatio >= 0 && cfg.otel.sampleRatio <= 1, "otel-sample-ratio", "must be between 0 and 1")
+
+	return v.Errors
+}
+
+// stringList is a flag.Value for a list of strings, given as a space-separated list.
+// Each use of the flag adds to the list.
+type stringList struct {
+	p *[]string
+}
+
+func (l stringList) String() string {
+	if l.p == nil {
+		return ""
+	}
+	return strings.Join(*l.p, " ")
+}
+
+func (l stringList) Set(val string) error {
+	*l.p = append(*l.p, strings.Fields(val)...)
+	return nil
+}
+
+func (l stringList) Get() any {
+	return *l.p
+}
+
+// regexpList is a flag.Value for a list of regular expressions, one for each use of the
+// flag.
+type regexpList struct {
+	p *[]*regexp.Regexp
+}
+
+func (l regexpList) String() string {
+	if l.p == nil {
+		return ""
+	}
+	return strings.Join(l.Get().([]string), " ")
+}
+
+func (l regexpList) Set(val string) error {
+	rx, err := regexp.Compile(val)
+	if err != nil {
+		return err
+	}
+
+	*l.p = append(*l.p, rx)
+	return nil
+}
+
+func (l regexpList) Get() any {
+	patterns := make([]string, len(*l.p))
+	for i, rx := range *l.p {
+		patterns[i] = rx.String()
+	}
+	return patterns
+}
+
+// headerMap is a flag.Value for a set of HTTP headers, given as comma-separated
+// key=value pairs. Each use of the flag adds to the set.
+type headerMap struct {
+	p *map[string]string
+}
+
+func (h headerMap) String() string {
+	if h.p == nil {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(*h.p))
+	for _, key := range slices.Sorted(maps.Keys(*h.p)) {
+		pairs = append(pairs, key+"="+(*h.p)[key])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (h headerMap) Set(val string) error {
+	if *h.p == nil {
+		*h.p = make(map[string]string)
+	}
+
+	for _, pair := range strings.Split(val, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("invalid header %q", pair)
+		}
+		(*h.p)[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return nil
+}
@@ -16,9 +16,47 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The key for the requestInfo which the requestID middleware adds to the context.
+const requestContextKey = contextKey("request")
+
+// requestInfo holds the details of a request which are needed once it has been handled,
+// e.g. for the access log. The requestID middleware adds it to the context as a
+// pointer, so that the middleware and handlers further down the chain can fill it in.
+type requestInfo struct {
+	id   string
+	user *data.User
+}
+
+// Returns a new copy of the request with the requestInfo added to the context.
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the requestInfo from the request context, or nil if there isn't one (e.g.
+// in handlers called directly rather than through the middleware chain).
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestContextKey).(*requestInfo)
+	return info
+}
+
+// Retrieves the request ID from the request context, or an empty string if there
+// isn't one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		return info.id
+	}
+	return ""
+}
+
 // Returns a new copy of the request with the provided User struct added to the context.
-// Note that we use our userContextKey constant as the key.
+// Note that we use our userContextKey constant as the key. The user is also recorded in
+// the requestInfo, for the access log.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		info.user = user
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
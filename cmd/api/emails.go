@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/mailer"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// Handler for the "GET /v1/admin/emails/templates" endpoint, which lists the email
+// templates and the locales each of them is available in.
+func (app *application) listEmailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := mailer.Templates()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"templates": templates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "POST /v1/admin/emails/preview" endpoint. It renders an email
+// template with the sample data supplied in the request body, so that administrators
+// can check their changes to the templates, and optionally sends the result to the
+// given address through the configured mailer.
+func (app *application) previewEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Template string         `json:"template"`
+		Locale   string         `json:"locale"`
+		Data     map[string]any `json:"data"`
+		SendTo   string         `json:"send_to"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Locale == "" {
+		input.Locale = mailer.DefaultLocale
+	}
+
+	v := validator.New()
+
+	v.Check(input.Template != "", "template", "must be provided")
+	data.ValidateLocale(v, input.Locale)
+
+	if input.SendTo != "" {
+		v.Check(validator.Matches(input.SendTo, validator.EmailRX), "send_to", "must be a valid email address")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Render the template. An unknown template is a validation error, and an error from
+	// parsing or executing the template is sent back to the client in full, as finding
+	// such errors is the point of this endpoint.
+	preview, err := mailer.Render(input.Locale, input.Template, input.Data)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrTemplateNotFound):
+			v.AddError("template", "no such template")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, map[string]string{"template": err.Error()})
+		}
+		return
+	}
+
+	env := envelope{"preview": preview}
+
+	// Send the test email straight away rather than through the outbox, so that any
+	// error from the mailer can be reported in the response.
+	if input.SendTo != "" {
+		err = app.mailer.Send(input.SendTo, input.Locale, input.Template, input.Data)
+		if err != nil {
+			app.logError(r, err)
+			app.errorResponse(w, r, http.StatusBadGateway, fmt.Sprintf("the test email could not be sent: %s", err))
+			return
+		}
+
+		env["message"] = fmt.Sprintf("a test email has been sent to %s", input.SendTo)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -7,17 +7,22 @@ import (
 
 // A generic helper for logging an error message. Method of the application struct.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.loggerFor(r).PrintError(err, map[string]any{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
 // A generic helper for sending JSON-formatted error messages to the client
-// with a given status code. Method of the application struct.
+// with a given status code. Method of the application struct. The request ID is
+// included, so that clients can quote it when reporting a problem.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	env := envelope{"error": message}
 
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
 	// Write the response using the writeJSON() helper. If this happens to return an
 	// error then log it, and fall back to sending the client an empty response with a
 	// 500 Internal Server Error status code.
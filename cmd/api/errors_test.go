@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+)
+
+func TestLogErrorRedactsRequestURL(t *testing.T) {
+	const token = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+
+	var buf bytes.Buffer
+
+	logger := jsonlog.New(&buf, jsonlog.LevelInfo)
+	logger.SetStackTraces(jsonlog.StackTracesOff)
+	logger.SetRedactor(jsonlog.NewDefaultRedactor(nil, nil))
+
+	app := &application{logger: logger}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/activated?token="+token+"&page=1", nil)
+
+	app.logError(r, errors.New("something went wrong"))
+
+	var entry struct {
+		Level      string            `json:"level"`
+		Properties map[string]string `json:"properties"`
+	}
+
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), token) {
+		t.Errorf("the token was written to the log: %s", buf.String())
+	}
+
+	if entry.Level != "ERROR" {
+		t.Errorf("got level %q; want %q", entry.Level, "ERROR")
+	}
+
+	want := "/v1/users/activated?token=[REDACTED]&page=1"
+	if entry.Properties["request_url"] != want {
+		t.Errorf("got request_url %q; want %q", entry.Properties["request_url"], want)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// How long changes are kept in the movie_changes log (and so how far back clients can
+// resume the event stream), how often a heartbeat is sent on idle streams, and how
+// many changes are read from the log at a time.
+const (
+	changeRetention      = 7 * 24 * time.Hour
+	eventsHeartbeat      = 15 * time.Second
+	eventsChangesPerRead = 100
+)
+
+// The changeBroker fans out the notifications of changes to the movies to the open
+// event streams. A notification carries no data: it just wakes up the streams, which
+// then read any changes they haven't sent yet from the log. This way a stream which
+// misses a notification (because it was busy) never misses a change.
+//
+// The streams only read the changes which have been given a position in the log, and
+// the listener gives the new changes their positions (with SequenceChanges()) before
+// it wakes the streams up.
+type changeBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newChangeBroker() *changeBroker {
+	return &changeBroker{
+		subscribers: make(map[chan struct{}]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Returns a channel which receives a value whenever there may be new changes, and a
+// function to unsubscribe. The channel has a buffer of one, so notifications which
+// arrive while the stream is busy are coalesced.
+func (b *changeBroker) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Wakes up all the subscribers.
+func (b *changeBroker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Tells the listener and all the open streams to stop. The HTTP server's Shutdown()
+// doesn't interrupt active requests, so without this it would wait for the streams
+// (which never finish on their own) until its timeout.
+func (b *changeBroker) close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// Starts listening for notifications on the movie_changes channel, which the trigger
+// on the movies table sends to, and passes them on to the broker once the new changes
+// have been given their positions. This uses a dedicated database connection, which
+// pq.Listener re-establishes if it is lost; after a reconnection we also wake up the
+// streams, in case we missed notifications in the meantime. The changes made while
+// no listener was running are sequenced when it starts. The listener also
+// periodically removes old changes from the log.
+func (app *application) startChangeListener(broker *changeBroker) {
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{"listener": "movie_changes"})
+		}
+	})
+
+	err := listener.Listen("movie_changes")
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{"listener": "movie_changes"})
+	}
+
+	// Every instance of the application sequences the changes when it is notified of
+	// them, and they take turns: by the time one instance has finished, the changes
+	// sequenced by another are visible too.
+	sequence := func() {
+		_, err := app.models.Movies.SequenceChanges()
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{"listener": "movie_changes"})
+		}
+		broker.notify()
+	}
+
+	app.background(func() {
+		defer listener.Close()
+
+		cleanup := time.NewTicker(time.Hour)
+		defer cleanup.Stop()
+
+		sequence()
+
+		for {
+			select {
+			case <-broker.done:
+				return
+
+			case <-listener.Notify:
+				sequence()
+
+			// Check that the connection is still alive if we haven't heard anything
+			// for a while, as recommended by the pq documentation.
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+
+			case <-cleanup.C:
+				err := app.models.Movies.DeleteChangesBefore(time.Now().Add(-changeRetention))
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			}
+		}
+	})
+}
+
+// Handler for the "GET /v1/movies/events" endpoint, a Server-Sent Events stream of the
+// changes to the movies. Each event has the position of the change in the log as its
+// ID (so the IDs go up in the order the events are sent, with no gaps), the event name
+// ("movie.created", "movie.updated" or "movie.deleted") and, as its data, the movie ID,
+// the time of the change and the movie after the change (except for deletions).
+//
+// A client which reconnects sends the ID of the last event it received in the
+// Last-Event-ID header (browsers do this automatically), and gets the changes it missed
+// from the log before the live changes. Clients which can't set the header can use the
+// last_event_id query string parameter instead. New clients only get changes which
+// happen after they connect.
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastPosition int64
+
+	if lastEventID != "" {
+		position, err := strconv.ParseInt(lastEventID, 10, 64)
+		v.Check(err == nil && position >= 0, "last_event_id", "must be a non-negative integer")
+		lastPosition = position
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Subscribe before reading from the log, so that no change can slip in between.
+	wake, unsubscribe := app.events.subscribe()
+	defer unsubscribe()
+
+	if lastEventID == "" {
+		position, err := app.models.Movies.LatestChangePosition()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		lastPosition = position
+	}
+
+	// The stream stays open indefinitely, so it mustn't be cut off by the server's
+	// WriteTimeout. Likewise the ReadTimeout, which would otherwise cancel the request
+	// context once it expires.
+	rc := http.NewResponseController(w)
+
+	err := rc.SetWriteDeadline(time.Time{})
+	if err == nil {
+		err = rc.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop proxies like nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Tell the client to wait 5 seconds before reconnecting if the stream is closed.
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		// Send any changes we haven't sent yet. Once the headers have been written, we
+		// can't send an error response, so errors are only logged and end the stream.
+		for {
+			changes, err := app.models.Movies.ChangesSince(lastPosition, eventsChangesPerRead)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			for _, change := range changes {
+				js, err := json.Marshal(change)
+				if err != nil {
+					app.logError(r, err)
+					return
+				}
+
+				_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Position, change.Event, js)
+				if err != nil {
+					return
+				}
+
+				lastPosition = change.Position
+			}
+
+			if len(changes) < eventsChangesPerRead {
+				break
+			}
+		}
+
+		err := rc.Flush()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-app.events.done:
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			// A comment line, which clients ignore, keeps the connection from being
+			// closed as idle by proxies, and lets us notice clients which have gone.
+			_, err = fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		}
+	}
+}
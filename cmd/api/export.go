@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// The number of movies fetched from the database and written to the client at a time
+// during an export, and how long we allow for writing each batch.
+const (
+	exportBatchSize    = 1000
+	exportWriteTimeout = 30 * time.Second
+)
+
+// Handler for the "GET /v1/movies/export" endpoint. Method of the application struct.
+//
+// It accepts the same filter and sort parameters as the "GET /v1/movies" endpoint, plus
+// a format parameter which is either "ndjson" (the default) or "csv". The export formats
+// are the same as the ones accepted by the "POST /v1/movies/import" endpoint.
+//
+// Unlike our other handlers, the response is not built in memory and sent with
+// writeJSON(). Instead, the movies are streamed from a database cursor and written out
+// batch by batch, so the export can be as large as the catalogue.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	movieFilters := app.readMovieFilters(qs, v)
+	format := app.readString(qs, "format", "ndjson")
+
+	// Only the sorting part of the Filters struct applies to exports. Relevance isn't
+	// supported as it is a computed value rather than a column.
+	filters := data.Filters{
+		Page:         1,
+		PageSize:     exportBatchSize,
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"},
+	}
+
+	data.ValidateMovieFilters(v, movieFilters)
+	data.ValidateFilters(v, filters)
+	v.Check(validator.PermittedValue(format, "ndjson", "csv"), "format", "must be ndjson or csv")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Pick the encoder for the requested format. The writeBatch function writes a batch
+	// of movies to the response body.
+	var writeBatch func(io.Writer, []*data.Movie) error
+	var csvHeaderWritten bool
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="movies.csv"`)
+
+		writeBatch = func(out io.Writer, movies []*data.Movie) error {
+			cw := csv.NewWriter(out)
+
+			if !csvHeaderWritten {
+				cw.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+				csvHeaderWritten = true
+			}
+
+			for _, movie := range movies {
+				cw.Write([]string{
+					strconv.FormatInt(movie.ID, 10),
+					movie.Title,
+					strconv.Itoa(int(movie.Year)),
+					strconv.Itoa(int(movie.Runtime)),
+					strings.Join(movie.Genres, "|"),
+					strconv.Itoa(int(movie.Version)),
+				})
+			}
+
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="movies.ndjson"`)
+
+		writeBatch = func(out io.Writer, movies []*data.Movie) error {
+			// json.Encoder writes each value followed by a newline, which is exactly the
+			// NDJSON format.
+			enc := json.NewEncoder(out)
+
+			for _, movie := range movies {
+				err := enc.Encode(movie)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+
+	// The http.Server has a 30-second WriteTimeout, which a large export would easily
+	// exceed. We use a http.ResponseController to push the write deadline back before
+	// every batch, so the export can take as long as it needs as long as it keeps
+	// making progress, and to flush each batch to the client as soon as it's written.
+	rc := http.NewResponseController(w)
+	headerWritten := false
+
+	err := app.modelsFor(r).Movies.Export(r.Context(), movieFilters, filters, exportBatchSize, func(movies []*data.Movie) error {
+		err := rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		if err != nil {
+			return err
+		}
+
+		if !headerWritten {
+			w.WriteHeader(http.StatusOK)
+			headerWritten = true
+		}
+
+		err = writeBatch(w, movies)
+		if err != nil {
+			return err
+		}
+
+		return rc.Flush()
+	})
+
+	// If the export failed before we wrote anything we can still send a proper error
+	// response. Otherwise, the status code has already been sent, so all we can do is
+	// log the error and stop -- the client will get a truncated body.
+	if err != nil {
+		if !headerWritten {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.logError(r, err)
+		return
+	}
+
+	// If there were no matching movies, we still need to send the response (with the
+	// CSV header line, if applicable).
+	if !headerWritten {
+		w.WriteHeader(http.StatusOK)
+		if format == "csv" {
+			writeBatch(w, nil)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long each check may take before it is failed, and how long the results of the
+// checks are reused for. Caching the results means that however many load balancers
+// and orchestrators are probing the instance, the checks only run every few seconds.
+const (
+	healthCheckTimeout = 2 * time.Second
+	healthCacheTTL     = 5 * time.Second
+)
+
+// A healthCheck is one of the checks made by the readiness endpoint. If a critical
+// check fails, the instance isn't ready to serve requests; other checks (like the job
+// queue lag) are reported, with a "warn" status, but don't affect the readiness.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// The result of a check, as shown in the response.
+type healthResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// healthChecker runs the registered checks for the readiness endpoint and caches the
+// results. It also records whether the server is shutting down, in which case the
+// instance is never ready.
+type healthChecker struct {
+	checks       []healthCheck
+	shuttingDown atomic.Bool
+
+	// The mutex is held while the checks run, so concurrent requests wait for (and
+	// share) the results, rather than all running the checks at once.
+	mu        sync.Mutex
+	results   map[string]healthResult
+	ready     bool
+	checkedAt time.Time
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{}
+}
+
+// Registers a check.
+func (h *healthChecker) register(name string, critical bool, check func(ctx context.Context) error) {
+	h.checks = append(h.checks, healthCheck{name: name, critical: critical, check: check})
+}
+
+// Returns the results of the checks, and whether all the critical checks passed,
+// running the checks (all at once) if the cached results are too old.
+func (h *healthChecker) run() (map[string]healthResult, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.results != nil && time.Since(h.checkedAt) < healthCacheTTL {
+		return h.results, h.ready
+	}
+
+	results := make(map[string]healthResult, len(h.checks))
+	ready := true
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range h.checks {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			err := runHealthCheck(c.check)
+
+			result := healthResult{
+				Status:    "pass",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+
+			if err != nil {
+				result.Status = "warn"
+				if c.critical {
+					result.Status = "fail"
+				}
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			results[c.name] = result
+			if err != nil && c.critical {
+				ready = false
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	h.results, h.ready, h.checkedAt = results, ready, time.Now()
+
+	return results, ready
+}
+
+// Runs the check with the timeout. The check is given up on once the timeout expires,
+// even if it doesn't respect the context itself (the database models, for example,
+// use their own timeouts).
+func runHealthCheck(check func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %s", healthCheckTimeout)
+	}
+}
+
+// Registers the checks for the readiness endpoint: that the database is reachable and
+// its schema is at least at the version of the latest embedded migration, that the
+// SMTP server is reachable (if the SMTP mailer transport is used and the check is
+// enabled), and that the job queue isn't lagging too far behind.
+func (app *application) registerHealthChecks(db *sql.DB) {
+	app.health.register("database", true, func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+
+	app.health.register("migrations", true, func(ctx context.Context) error {
+		version, dirty, err := app.models.Schema.Version()
+		if err != nil {
+			return err
+		}
+
+		// The schema may be ahead of the embedded migrations if a newer version of the
+		// application has been rolled back, which is fine (as at startup).
+		switch latest := app.migrator.Latest(); {
+		case dirty:
+			return fmt.Errorf("schema version %d is dirty", version)
+		case version < latest:
+			return fmt.Errorf("schema version is %d, expected %d", version, latest)
+		}
+
+		return nil
+	})
+
+	// The mailer settings can be changed by reloading the configuration, so the check
+	// is always registered (if enabled), and passes while SMTP isn't used. It is only a
+	// warning: the emails wait in the outbox while the SMTP server is unreachable, so
+	// the instance can still serve requests.
+	if app.config.health.checkSMTP {
+		app.health.register("smtp", false, func(ctx context.Context) error {
+			cfg := app.currentConfig()
+			if cfg.mailer.transport != "smtp" {
+				return nil
+			}
+
+			addr := net.JoinHostPort(cfg.smtp.host, strconv.Itoa(cfg.smtp.port))
+
+			var d net.Dialer
+
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		})
+	}
+
+	app.health.register("job_queue", false, func(ctx context.Context) error {
+		lag, err := app.models.Jobs.QueueLag()
+		if err != nil {
+			return err
+		}
+
+		if lag > app.config.health.maxJobLag {
+			return fmt.Errorf("oldest due job has been waiting for %s", lag.Round(time.Second))
+		}
+
+		return nil
+	})
+}
+
+// Handler for the "GET /v1/healthz/live" endpoint. It only shows that the application
+// is running and able to respond, without checking any of its dependencies, so that an
+// orchestrator doesn't restart it because the database is down (which a restart
+// wouldn't fix).
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status": "alive",
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "GET /v1/healthz/ready" endpoint. It runs the registered checks and
+// responds with 200 OK if the instance is ready to serve requests, or 503 Service
+// Unavailable if it isn't (or is shutting down), along with the status and latency of
+// each check.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if app.health.shuttingDown.Load() {
+		err := app.writeJSON(w, http.StatusServiceUnavailable, envelope{"status": "shutting down"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	results, ready := app.health.run()
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+
+	err := app.writeJSON(w, code, envelope{"status": status, "checks": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,10 +10,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"maps"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+	"greenlight.mazavrbazavr.ru/internal/mailer"
 	"greenlight.mazavrbazavr.ru/internal/validator"
 )
 
@@ -224,6 +229,91 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// A helper that reads a string value from the query string (qs) and converts it to a
+// boolean before returning. It accepts the same values as strconv.ParseBool() (like
+// "true", "false", "1" and "0"). If no matching key could be found it returns the
+// provided default value. If the value couldn't be converted, then we record an error
+// message in the provided Validator (v) instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	// Extract the value from the query string.
+	s := qs.Get(key)
+
+	// If no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// A helper that reads a string value from the query string (qs) and parses it as a
+// timestamp. Both full RFC 3339 timestamps ("2024-01-02T15:04:05Z") and plain dates
+// ("2024-01-02", interpreted as midnight UTC) are accepted. If no matching key could be
+// found it returns the provided default value. If the value couldn't be parsed, then we
+// record an error message in the provided Validator (v) instance.
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	// Extract the value from the query string.
+	s := qs.Get(key)
+
+	// If no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
+
+	// Try the more specific RFC 3339 layout first, then fall back to a plain date.
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t
+	}
+
+	t, err = time.Parse(time.DateOnly, s)
+	if err != nil {
+		v.AddError(key, "must be a RFC 3339 timestamp or a YYYY-MM-DD date")
+		return defaultValue
+	}
+
+	return t
+}
+
+// The readLocale() helper returns the locale from the Accept-Language header which
+// best matches one of the locales we have email templates for, taking the quality
+// values into account (e.g. "ru-RU,ru;q=0.9,en;q=0.8"). If there is no match, it
+// returns the default locale.
+func (app *application) readLocale(r *http.Request) string {
+	supported := mailer.Locales()
+
+	best, bestQuality := mailer.DefaultLocale, 0.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if quality <= bestQuality {
+			continue
+		}
+
+		if locale := mailer.Match(tag, supported); locale != "" {
+			best, bestQuality = locale, quality
+		}
+	}
+
+	return best
+}
+
 // The background() helper accepts an arbitrary function as a parameter and executes it
 // in the backgound goroutine, recovering from panics if any.
 func (app *application) background(fn func()) {
@@ -246,3 +336,63 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// Returns a child logger which adds the request ID and, once the request has been
+// authenticated, the user ID to the log entries about the request.
+func (app *application) loggerFor(r *http.Request) *jsonlog.Logger {
+	info := app.contextGetRequestInfo(r)
+	if info == nil {
+		return app.logger
+	}
+
+	properties := map[string]any{"request_id": info.id}
+
+	if info.user != nil && !info.user.IsAnonymous() {
+		properties["user_id"] = info.user.ID
+	}
+
+	return app.logger.With(properties)
+}
+
+// Returns the models bound to the request context, so that their database queries are
+// traced as part of the request. Handlers use this instead of app.models, which the
+// background workers use.
+func (app *application) modelsFor(r *http.Request) data.Models {
+	return app.models.WithContext(r.Context())
+}
+
+// Reports whether a request ID sent by the client can be used: it must be between 1
+// and 128 characters long, and contain only letters, digits and the characters "-",
+// "_", ".", ":" and "/", so that it can't be used to inject anything into the logs or
+// the response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/", c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Generates a random request ID, formatted as a version 4 UUID.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4.
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant.
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// The maximum size of an import request body (10MB) and the maximum number of movies
+// which can be imported in one go.
+const (
+	maxImportBytes = 10_485_760
+	maxImportRows  = 10_000
+)
+
+// An importRow holds a movie parsed from a single line of the import file, along with
+// the line number (so that we can refer to it in the report) and any errors found while
+// parsing or validating it.
+type importRow struct {
+	line   int
+	movie  *data.Movie
+	errors map[string]string
+}
+
+// The report sent back to the client after an import: the IDs of the movies which were
+// created and the errors for the lines which weren't, both keyed by line number.
+type importReport struct {
+	Created []importCreated `json:"created"`
+	Errors  []importError   `json:"errors"`
+}
+
+type importCreated struct {
+	Line int   `json:"line"`
+	ID   int64 `json:"id"`
+}
+
+type importError struct {
+	Line   int               `json:"line"`
+	Errors map[string]string `json:"errors"`
+}
+
+// Handler for the "POST /v1/movies/import" endpoint. Method of the application struct.
+//
+// The request body is either CSV (Content-Type: text/csv) with a header line naming the
+// title, year, runtime and genres columns, or NDJSON (Content-Type:
+// application/x-ndjson) with one JSON object per line in the same format as the body
+// of a "POST /v1/movies" request. In CSV files the runtime is the number of minutes and
+// the genres are separated by the "|" character.
+//
+// By default the import is atomic: if any of the lines is invalid, nothing is imported.
+// With the "mode=best_effort" query string parameter all the valid lines are imported
+// regardless. With "async=true" the movies are inserted by a background job.
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	mode := app.readString(r.URL.Query(), "mode", "atomic")
+	v.Check(validator.PermittedValue(mode, "atomic", "best_effort"), "mode", "must be atomic or best_effort")
+
+	async := app.readBool(r.URL.Query(), "async", false, v)
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	v.Check(validator.PermittedValue(mediaType, "text/csv", "application/x-ndjson"), "Content-Type", "must be text/csv or application/x-ndjson")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Limit the size of the request body, like we do in readJSON() but with a more
+	// generous limit.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var rows []*importRow
+
+	switch mediaType {
+	case "text/csv":
+		rows, err = readImportCSV(r.Body)
+	default:
+		rows, err = readImportNDJSON(r.Body)
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if len(rows) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must contain at least one movie"))
+		return
+	}
+
+	// Validate each movie and split the rows into the valid ones and those with errors.
+	report := importReport{Created: []importCreated{}, Errors: []importError{}}
+	valid := []*importRow{}
+
+	for _, row := range rows {
+		if row.errors == nil {
+			rv := validator.New()
+			if data.ValidateMovie(rv, row.movie); !rv.Valid() {
+				row.errors = rv.Errors
+			}
+		}
+
+		if row.errors != nil {
+			report.Errors = append(report.Errors, importError{Line: row.line, Errors: row.errors})
+			continue
+		}
+
+		valid = append(valid, row)
+	}
+
+	// In atomic mode, any invalid line means that we don't import anything and send
+	// back the report with a 422 Unprocessable Entity status code.
+	if mode == "atomic" && len(report.Errors) > 0 {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	// Large imports can take a while, so the client can ask for the import to be run
+	// as a background job instead. In that case we send a 202 Accepted response
+	// straight away, with the job which they can poll for progress and the report.
+	if async {
+		payload := importJobPayload{Mode: mode, Errors: report.Errors}
+		for _, row := range valid {
+			payload.Rows = append(payload.Rows, importJobRow{Line: row.line, Movie: row.movie})
+		}
+
+		// Import jobs are never retried, in either mode. A best effort import may have
+		// inserted some of the movies before failing, and even an atomic one commits the
+		// movies before the job is marked as succeeded: if the worker crashes or loses
+		// its lease in between, a retry would insert all the movies again.
+		job, err := app.enqueueJob(app.contextGetUser(r).ID, jobKindMoviesImport, 1, payload)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		headers := make(http.Header)
+		headers.Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, headers)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The import carries on if the client goes away, so we only pass on the values of
+	// the request context (which keep the queries in the request's trace), not its
+	// cancellation.
+	err = app.importMovies(context.WithoutCancel(r.Context()), mode, valid, &report, func(int) {})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if len(report.Created) == 0 {
+		status = http.StatusOK
+	}
+
+	err = app.writeJSON(w, status, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Inserts the valid movies from an import and adds them to the report. In atomic mode
+// they are all inserted in a single transaction, and any error is returned. In best
+// effort mode they are inserted one by one, so that a database error for one of them
+// (like a check constraint violation) doesn't prevent the others from being imported;
+// such errors are reported against the line instead. The progress function is called
+// with the percentage of the movies processed so far.
+//
+// The import stops (returning the cause) as soon as the context is cancelled, e.g.
+// because the job running it has lost its lease.
+func (app *application) importMovies(ctx context.Context, mode string, valid []*importRow, report *importReport, progress func(int)) error {
+	models := app.models.WithContext(ctx)
+
+	switch mode {
+	case "atomic":
+		movies := make([]*data.Movie, len(valid))
+		for i, row := range valid {
+			movies[i] = row.movie
+		}
+
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		err := models.Movies.InsertAll(movies)
+		if err != nil {
+			return err
+		}
+
+	case "best_effort":
+		imported := valid[:0]
+
+		for i, row := range valid {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+
+			err := models.Movies.Insert(row.movie)
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{"line": row.line})
+				report.Errors = append(report.Errors, importError{
+					Line:   row.line,
+					Errors: map[string]string{"movie": "could not be saved"},
+				})
+				continue
+			}
+
+			imported = append(imported, row)
+
+			if (i+1)%100 == 0 {
+				progress((i + 1) * 100 / len(valid))
+			}
+		}
+
+		valid = imported
+	}
+
+	created := make([]any, len(valid))
+	for i, row := range valid {
+		report.Created = append(report.Created, importCreated{Line: row.line, ID: row.movie.ID})
+		created[i] = row.movie
+	}
+
+	// Send a movie.created event for each imported movie, all queued with one query.
+	app.emitEvent(data.EventMovieCreated, created...)
+
+	return nil
+}
+
+// The payload of a background import job: the import mode, the valid movies with
+// their line numbers and the errors found while parsing and validating the file.
+type importJobPayload struct {
+	Mode   string         `json:"mode"`
+	Rows   []importJobRow `json:"rows"`
+	Errors []importError  `json:"errors"`
+}
+
+type importJobRow struct {
+	Line  int         `json:"line"`
+	Movie *data.Movie `json:"movie"`
+}
+
+// Runs a background import job, returning the import report as its result.
+func (app *application) runImportJob(ctx context.Context, job *data.Job, progress func(int)) (any, error) {
+	var payload importJobPayload
+
+	err := json.Unmarshal(job.Payload, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := make([]*importRow, len(payload.Rows))
+	for i, row := range payload.Rows {
+		valid[i] = &importRow{line: row.Line, movie: row.Movie}
+	}
+
+	report := importReport{Created: []importCreated{}, Errors: payload.Errors}
+
+	err = app.importMovies(ctx, payload.Mode, valid, &report, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Reads the movies from a CSV file. The first line must be a header naming the title,
+// year, runtime and genres columns (in any order). Problems with individual lines are
+// recorded in the rows, while problems with the file as a whole are returned as an
+// error.
+func readImportCSV(body io.Reader) ([]*importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, importReadError(err, "body must start with a CSV header line")
+	}
+
+	// Work out the position of each of the columns from the header.
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header must contain a %q column", name)
+		}
+	}
+
+	rows := []*importRow{}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		// A *csv.ParseError relates to a single line, so we record it against that line
+		// and carry on. Anything else means that we can't read the body at all.
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			rows = append(rows, &importRow{line: parseError.StartLine, errors: map[string]string{"line": parseError.Err.Error()}})
+			continue
+		}
+		if err != nil {
+			return nil, importReadError(err, "")
+		}
+
+		if len(rows) == maxImportRows {
+			return nil, fmt.Errorf("body must not contain more than %d movies", maxImportRows)
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := &importRow{line: line, movie: &data.Movie{}}
+		rows = append(rows, row)
+
+		if len(record) != len(header) {
+			row.errors = map[string]string{"line": fmt.Sprintf("must have %d fields", len(header))}
+			continue
+		}
+
+		errs := map[string]string{}
+
+		row.movie.Title = record[columns["title"]]
+
+		if year := record[columns["year"]]; year != "" {
+			i, err := strconv.ParseInt(year, 10, 32)
+			if err != nil {
+				errs["year"] = "must be an integer value"
+			}
+			row.movie.Year = int32(i)
+		}
+
+		// Accept the runtime either as a plain number of minutes or in the same
+		// "<runtime> mins" format used in our JSON.
+		if runtime := strings.TrimSuffix(record[columns["runtime"]], " mins"); runtime != "" {
+			i, err := strconv.ParseInt(runtime, 10, 32)
+			if err != nil {
+				errs["runtime"] = "must be an integer number of minutes"
+			}
+			row.movie.Runtime = data.Runtime(i)
+		}
+
+		if genres := record[columns["genres"]]; genres != "" {
+			row.movie.Genres = strings.Split(genres, "|")
+		}
+
+		if len(errs) > 0 {
+			row.errors = errs
+		}
+	}
+
+	return rows, nil
+}
+
+// Reads the movies from a NDJSON file, where every non-blank line is a JSON object in
+// the same format as the body of a "POST /v1/movies" request.
+func readImportNDJSON(body io.Reader) ([]*importRow, error) {
+	rows := []*importRow{}
+	line := 0
+
+	// We read the body line by line, rather than decoding a stream of JSON values, so
+	// that a malformed line can be reported against its line number without affecting
+	// the following lines. Each line can be up to 1MB long.
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1_048_576)
+
+	for scanner.Scan() {
+		text := scanner.Text()
+		line++
+
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		if len(rows) == maxImportRows {
+			return nil, fmt.Errorf("body must not contain more than %d movies", maxImportRows)
+		}
+
+		var input struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil {
+			rows = append(rows, &importRow{line: line, errors: map[string]string{"line": "contains invalid JSON: " + err.Error()}})
+			continue
+		}
+
+		// As in readJSON(), decoding again must hit the end of the line. Anything else
+		// means that there is more than the one JSON object on the line.
+		err = dec.Decode(&struct{}{})
+		if err != io.EOF {
+			rows = append(rows, &importRow{line: line, errors: map[string]string{"line": "must only contain a single JSON object"}})
+			continue
+		}
+
+		rows = append(rows, &importRow{
+			line: line,
+			movie: &data.Movie{
+				Title:   input.Title,
+				Year:    input.Year,
+				Runtime: input.Runtime,
+				Genres:  input.Genres,
+			},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, importReadError(err, "")
+	}
+
+	return rows, nil
+}
+
+// Converts an error from reading the request body into a message for the client.
+// A body which is too large gets the same message as in readJSON(), and an empty body
+// gets the provided message (if any).
+func importReadError(err error, emptyMessage string) error {
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	case errors.Is(err, io.EOF) && emptyMessage != "":
+		return errors.New(emptyMessage)
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+	default:
+		return err
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+)
+
+// The kinds of background jobs which the application knows how to run.
+const (
+	jobKindMoviesImport = "movies.import"
+)
+
+// A jobHandler runs a background job of a specific kind. It receives the job (with its
+// payload) and a function to report progress as a percentage, and returns the result
+// of the job, which will be stored as JSON.
+type jobHandler func(ctx context.Context, job *data.Job, progress func(int)) (any, error)
+
+// Returns the handlers for each kind of job.
+func (app *application) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobKindMoviesImport: app.runImportJob,
+	}
+}
+
+// How long a worker can hold on to a job without reporting progress before the job
+// is considered abandoned (e.g. because the process crashed) and handed to another
+// worker, and the limits for the exponential back-off between retries.
+const (
+	jobLease          = 5 * time.Minute
+	jobRetryBaseDelay = 10 * time.Second
+	jobRetryMaxDelay  = time.Hour
+)
+
+// Adds a job of the given kind to the queue, on behalf of the user, and returns it.
+// The job is run by one of the workers started by startJobWorkers(), in this or any
+// other instance of the application.
+func (app *application) enqueueJob(userID int64, kind string, maxAttempts int, payload any) (*data.Job, error) {
+	job := &data.Job{
+		UserID:      userID,
+		Kind:        kind,
+		MaxAttempts: maxAttempts,
+	}
+
+	err := app.models.Jobs.Insert(job, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Starts the configured number of job workers in the background. The workers stop
+// claiming new jobs once the done channel is closed, but finish the job they are
+// running first. They are tracked by the app.wg WaitGroup, so the graceful shutdown in
+// serve() waits for them.
+func (app *application) startJobWorkers(done <-chan struct{}) {
+	handlers := app.jobHandlers()
+
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.background(func() {
+			for {
+				// Keep running jobs for as long as there are any due. When the queue is
+				// empty (or we hit an error), wait for the poll interval before trying
+				// again, unless we're shutting down.
+				ran := app.runNextJob(handlers)
+
+				if !ran {
+					select {
+					case <-done:
+						return
+					case <-time.After(app.config.jobs.pollInterval):
+					}
+				}
+
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		})
+	}
+}
+
+// Claims the next job which is due and runs it, recording the outcome in the database.
+// Returns whether a job was run.
+func (app *application) runNextJob(handlers map[string]jobHandler) bool {
+	job, err := app.models.Jobs.Claim(jobLease)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.PrintError(err, nil)
+		}
+		return false
+	}
+
+	logger := app.logger.With(map[string]any{
+		"job_id":   job.ID,
+		"job_kind": job.Kind,
+		"attempt":  job.Attempts,
+	})
+
+	// The job isn't ours any more if we lost the lease while running it, or by the time
+	// we come to record the outcome (which the model methods then refuse to do). Its
+	// outcome is for whoever holds it now, or it has already been marked as failed.
+	leaseLost := func() bool {
+		logger.PrintWarn("job lease lost", nil)
+		return true
+	}
+
+	result, err := app.runJob(handlers, job)
+	if errors.Is(err, errJobLeaseLost) {
+		return leaseLost()
+	}
+	if err != nil {
+		// A failed attempt is only a warning if the job will be retried.
+		if job.Attempts < job.MaxAttempts {
+			logger.PrintWarn("job attempt failed", map[string]any{"error": err})
+		} else {
+			logger.PrintError(err, nil)
+		}
+
+		err = app.models.Jobs.Fail(job, err, retryDelay(job.Attempts, jobRetryBaseDelay, jobRetryMaxDelay))
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return leaseLost()
+		case err != nil:
+			logger.PrintError(err, nil)
+		}
+		return true
+	}
+
+	err = app.models.Jobs.Succeed(job, result)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return leaseLost()
+	case err != nil:
+		logger.PrintError(err, nil)
+		return true
+	}
+
+	logger.PrintDebug("job succeeded", nil)
+
+	return true
+}
+
+// The cause of the cancellation of a job's context when the worker can no longer extend
+// the lease on the job.
+var errJobLeaseLost = errors.New("job lease lost")
+
+// Runs the handler for the job, converting a panic in the handler into an error so that
+// it counts as a failed attempt instead of bringing down the worker.
+//
+// While the handler runs, the lease on the job is extended every third of jobLease in
+// the background, so that jobs which don't report progress aren't handed to another
+// worker. If the lease can't be extended, the context passed to the handler is
+// cancelled with errJobLeaseLost as its cause, and that is the error returned.
+func (app *application) runJob(handlers map[string]jobHandler, job *data.Job) (result any, err error) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s", p)
+		}
+
+		if errors.Is(context.Cause(ctx), errJobLeaseLost) {
+			result, err = nil, errJobLeaseLost
+		}
+	}()
+
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+
+	models := app.models.WithContext(ctx)
+
+	// Gives up on the job if the error shows that it is no longer ours. Other errors
+	// (e.g. the database being briefly unreachable) are only logged, as the lease is
+	// still good for a while.
+	extended := func(err error) {
+		switch {
+		case err == nil:
+		case errors.Is(err, data.ErrRecordNotFound):
+			cancel(errJobLeaseLost)
+		default:
+			app.logger.PrintError(err, nil)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(jobLease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				extended(models.Jobs.ExtendLease(job, jobLease))
+			}
+		}
+	}()
+
+	// Reporting progress also extends the lease on the job.
+	progress := func(percent int) {
+		extended(models.Jobs.UpdateProgress(job, percent, jobLease))
+	}
+
+	return handler(ctx, job, progress)
+}
+
+// Returns how long to wait before retrying after the given number of failed attempts.
+// The delay doubles with every attempt, starting at base (e.g. 10s, 20s, 40s...), up to
+// the given maximum.
+func retryDelay(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+
+	return min(delay, max)
+}
+
+// Handler for the "GET /v1/jobs/:id" endpoint, which clients use to poll the status,
+// progress and result of a job they started. Method of the application struct.
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.modelsFor(r).Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Users can only see their own jobs. We send a 404 Not Found response for other
+	// users' jobs, so as not to reveal that the job exists.
+	if job.UserID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// Returns a logger for the configuration, along with a function which closes the log
+// file and the connection to syslog, if they are used.
+func newLogger(cfg config) (*jsonlog.Logger, func(), error) {
+	var sinks []jsonlog.Sink
+	var closers []io.Closer
+
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	if cfg.log.stdout.enabled {
+		sinks = append(sinks, jsonlog.Sink{Writer: os.Stdout, MinLevel: cfg.log.stdout.level})
+	}
+
+	if cfg.log.file.path != "" {
+		file, err := jsonlog.NewRotatingFile(
+			cfg.log.file.path,
+			int64(cfg.log.file.maxSize)*1024*1024,
+			cfg.log.file.maxAge,
+			cfg.log.file.maxBackups,
+			cfg.log.file.retention,
+		)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		sinks = append(sinks, jsonlog.Sink{Writer: file, MinLevel: cfg.log.file.level})
+		closers = append(closers, file)
+	}
+
+	if cfg.log.syslog.enabled {
+		syslog, err := jsonlog.NewSyslog(cfg.log.syslog.tag)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		sinks = append(sinks, jsonlog.Sink{Writer: syslog, MinLevel: cfg.log.syslog.level})
+		closers = append(closers, syslog)
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil, errors.New("no log sinks enabled")
+	}
+
+	logger := jsonlog.NewWithSinks(cfg.log.level, sinks...)
+	logger.SetStackTraces(cfg.log.stackTraces)
+
+	// Unless it has been turned off, redact any sensitive data from the log entries
+	// before they are written. This includes the tokens in the emails written to the log
+	// by the log mailer transport, which is why redaction is off by default with
+	// -env=development (see loadConfig()).
+	if cfg.log.redact {
+		logger.SetRedactor(jsonlog.NewDefaultRedactor(cfg.log.redactKeys, cfg.log.redactPatterns))
+	}
+
+	return logger, closeAll, nil
+}
+
+// Handler for the "GET /v1/admin/log-level" endpoint, which shows the current minimum
+// severity level of the log.
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "PUT /v1/admin/log-level" endpoint, which changes the minimum
+// severity level of the log without restarting the application, e.g. to turn on DEBUG
+// entries while investigating a problem. The change only lasts until the application
+// is restarted, and only applies to this instance of it.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(input.Level)
+	v.Check(input.Level != "", "level", "must be provided")
+	v.Check(input.Level == "" || err == nil, "level", "must be one of debug, info, warn, error, fatal or off")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+
+	// Record the change at WARN, so that it shows up unless the log has been turned off.
+	app.loggerFor(r).PrintWarn("log level changed", map[string]any{
+		"from": previous,
+		"to":   level,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"level": level}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
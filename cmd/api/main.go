@@ -3,20 +3,28 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
+	"regexp"
 	"runtime"
-	"strings"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"greenlight.mazavrbazavr.ru/internal/data"
 	"greenlight.mazavrbazavr.ru/internal/jsonlog"
 	"greenlight.mazavrbazavr.ru/internal/mailer"
+	"greenlight.mazavrbazavr.ru/internal/metrics"
+	"greenlight.mazavrbazavr.ru/internal/migrate"
+	"greenlight.mazavrbazavr.ru/internal/tracing"
 	"greenlight.mazavrbazavr.ru/internal/vcs"
+	"greenlight.mazavrbazavr.ru/migrations"
 )
 
 // Application version.
@@ -28,7 +36,35 @@ var (
 type config struct {
 	port int
 	env  string
-	db   struct {
+	// The minimum severity level of the log entries which are written, and whether
+	// sensitive data is redacted from them, with any keys and patterns to redact on top
+	// of the defaults. Then the settings for each of the sinks the log is written to,
+	// and which entries include a stack trace.
+	log struct {
+		level          jsonlog.Level
+		redact         bool
+		redactKeys     []string
+		redactPatterns []*regexp.Regexp
+		stdout         struct {
+			enabled bool
+			level   jsonlog.Level
+		}
+		file struct {
+			path       string
+			level      jsonlog.Level
+			maxSize    int
+			maxAge     time.Duration
+			maxBackups int
+			retention  time.Duration
+		}
+		syslog struct {
+			enabled bool
+			level   jsonlog.Level
+			tag     string
+		}
+		stackTraces jsonlog.StackTraceMode
+	}
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -37,91 +73,170 @@ type config struct {
 	// A limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting
 	// altogether.
+	// The suggest struct holds the separate settings for the title suggestions
+	// endpoint. It's a separate, tighter bucket: a search box calling it on every
+	// keystroke is expected to debounce its requests (and repeated queries are served
+	// from the cache), and hammering the suggestions doesn't use up a client's requests
+	// to the other endpoints, or vice versa.
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
+		suggest struct {
+			rps   float64
+			burst int
+		}
+	}
+	// The mailer transport (smtp, file or log) and the sender address used for all of
+	// them, plus the settings specific to the SMTP and file transports.
+	mailer struct {
+		transport string
+		sender    string
+		dir       string
 	}
 	smtp struct {
 		host     string
 		port     int
 		username string
 		password string
-		sender   string
 	}
 	cors struct {
 		trustedOrigins []string
 	}
+	// The number of background job workers, and how often an idle worker checks the
+	// queue for new jobs.
+	jobs struct {
+		workers      int
+		pollInterval time.Duration
+	}
+	// How often the outbox worker checks for emails to send, and how many times it
+	// tries to deliver an email before giving up on it.
+	outbox struct {
+		pollInterval time.Duration
+		maxAttempts  int
+	}
+	// The same for the webhook worker, plus the timeout for each delivery.
+	webhooks struct {
+		pollInterval time.Duration
+		maxAttempts  int
+		timeout      time.Duration
+	}
+	// Whether the readiness check includes the SMTP server, the job queue lag above
+	// which it warns, and how long the server keeps running (reporting that it isn't
+	// ready) after a shutdown signal, so that load balancers stop sending it requests.
+	health struct {
+		checkSMTP     bool
+		maxJobLag     time.Duration
+		shutdownDelay time.Duration
+	}
+	// The OTLP/HTTP endpoint of the OpenTelemetry collector to send traces to (tracing
+	// is disabled if it's empty), any extra headers for the requests to it, the service
+	// name for the traces, and the ratio of new traces which are sampled.
+	otel struct {
+		endpoint    string
+		headers     map[string]string
+		serviceName string
+		sampleRatio float64
+	}
 }
 
 // Struct to hold the dependencies for HTTP handlers, helpers, and middleware.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	// The configuration the server started with, and the current configuration, which
+	// differs in the settings changed by reloading the configuration on SIGHUP (see
+	// reloadConfig()). The loaded configuration is the one last loaded, which the next
+	// reload is compared with.
+	config  config
+	current atomic.Pointer[config]
+	loaded  *loadedConfig
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	// The innermost mailer, which passes the emails on to the mailer for the current
+	// settings.
+	swappableMailer *swappableMailer
+	events          *changeBroker
+	// The metrics exposed in the Prometheus format on the /metrics endpoint.
+	registry *metrics.Registry
+	// The tracer for the OpenTelemetry spans, which is nil if tracing is disabled.
+	tracer *tracing.Tracer
+	// The checks for the readiness endpoint.
+	health *healthChecker
+	// The migrator for the embedded migrations, which the readiness endpoint uses to
+	// find the expected schema version.
+	migrator *migrate.Migrator
+	wg       sync.WaitGroup
 }
 
 func main() {
-	// Declare an instance of the config struct.
-	var cfg config
-
-	// Read the value of the port and env command-line flags into the config struct.
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-	// Read the DSN value from the db-dsn command-line flag into the config struct. We
-	// default to using the GREENLIGHT_DB_DSN environment variable if no flag
-	// is provided.
-	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
-
-	// Rate limiting
-
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
-
-	// Read the SMTP server configuration settings into the config struct, using the
-	// Mailtrap settings as the default values.
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "1bf279a820e508", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "3f2c435b31834b", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.mazavrbazavr.ru>", "SMTP sender")
-
-	// Use the flag.Func() function to process the -cors-trusted-origins command line
-	// flag. In this we use the strings.Fields() function to split the flag value into a
-	// slice based on whitespace characters and assign it to our config struct.
-	// Importantly, if the -cors-trusted-origins flag is not present, contains the empty
-	// string, or contains only whitespace, then strings.Fields() will return an empty
-	// []string slice.
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
-		cfg.cors.trustedOrigins = strings.Fields(val)
-		return nil
-	})
-
-	displayVersion := flag.Bool("version", false, "Display version and exit")
-
-	flag.Parse()
+	// Load the configuration from the defaults, the configuration file, the environment
+	// and the command-line flags (see loadConfig()).
+	loaded, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			os.Exit(0)
+		case errors.Is(err, errInvalidFlags):
+			os.Exit(2)
+		default:
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(2)
+		}
+	}
+
+	cfg := loaded.cfg
 
 	// If the version flag value is true, then print out the version number and
 	// immediately exit.
-	if *displayVersion {
+	if loaded.displayVersion {
 		fmt.Printf("Version:\t%s\n", version)
 		os.Exit(0)
 	}
 
-	// Initialize a new jsonlog.Logger which writes any messages *at or above* the INFO
-	// severity level to the standard out stream.
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	// With -print-config, print the effective configuration, followed by any errors in
+	// it, and exit.
+	if loaded.printConfig {
+		err := loaded.write(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Refuse to start with an invalid configuration, listing all the problems with it
+	// rather than only the first.
+	if errs := cfg.validate(); len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		for _, key := range slices.Sorted(maps.Keys(errs)) {
+			fmt.Fprintf(os.Stderr, "  -%s: %s\n", key, errs[key])
+		}
+		os.Exit(2)
+	}
+
+	if loaded.printConfig {
+		os.Exit(0)
+	}
+
+	// Initialize a new jsonlog.Logger which writes any messages *at or above* the
+	// configured severity level (INFO by default) to the configured sinks (by default
+	// just the standard out stream). If that fails, there's nowhere to log the error
+	// but standard error.
+	logger, closeLog, err := newLogger(cfg)
+	if err != nil {
+		jsonlog.New(os.Stderr, jsonlog.LevelInfo).PrintFatal(err, nil)
+	}
+
+	// Close the log file and syslog connection (if any) before main() exits.
+	defer closeLog()
+
+	// Create the tracer first, so that the connection pool can create spans for the
+	// database queries.
+	tracer := newTracer(cfg, logger)
 
 	// Call the openDB() helper function (see below) to create the connection pool,
-	// passing in the config struct. If this returns an error, we log it and exit the
+	// passing in the config struct and the tracer. If this returns an error, we log it and exit the
 	// application immediately.
-	db, err := openDB(cfg)
+	db, err := openDB(cfg, tracer)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
@@ -134,6 +249,31 @@ func main() {
 	// established.
 	logger.PrintInfo("database connection pool established", nil)
 
+	// Create the migrator for the migrations embedded in the binary. If the first
+	// argument after the flags is "migrate", run the migrate subcommand (e.g.
+	// "api -db-dsn=... migrate up") and exit. Otherwise, refuse to start the server if
+	// the database schema isn't up to date.
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if loaded.flags.Arg(0) == "migrate" {
+		err = runMigrate(migrator, loaded.flags.Args()[1:], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			db.Close()
+			closeLog()
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = checkSchema(migrator)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// Publish a new "version" variable in the expvar handler containing our application
 	// version number.
 	expvar.NewString("version").Set(version)
@@ -153,13 +293,35 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	// Create the registry for the Prometheus metrics, and register the database
+	// connection pool metrics.
+	registry := metrics.NewRegistry()
+	registerDBMetrics(registry, db)
+
+	appMailer, err := newMailer(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	swappable := newSwappableMailer(appMailer)
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:          cfg,
+		loaded:          loaded,
+		logger:          logger,
+		models:          data.NewModels(db),
+		mailer:          newTracedMailer(newInstrumentedMailer(swappable, registry), tracer),
+		swappableMailer: swappable,
+		registry:        registry,
+		tracer:          tracer,
+		health:          newHealthChecker(),
+		migrator:        migrator,
 	}
 
+	app.current.Store(&cfg)
+
+	app.registerHealthChecks(db)
+
 	// Call app.serve() to start the server.
 	err = app.serve()
 	if err != nil {
@@ -167,15 +329,32 @@ func main() {
 	}
 }
 
+// Returns the mailer for the configured transport.
+func newMailer(cfg config, logger *jsonlog.Logger) (mailer.Mailer, error) {
+	switch cfg.mailer.transport {
+	case "smtp":
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.mailer.sender), nil
+	case "file":
+		return mailer.NewFile(cfg.mailer.dir, cfg.mailer.sender)
+	case "log":
+		return mailer.NewLog(logger, cfg.mailer.sender), nil
+	default:
+		return nil, fmt.Errorf("invalid mailer transport %q", cfg.mailer.transport)
+	}
+}
+
 // Returns a sql.DB connection pool.
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create an empty connection pool, using the DSN from the config
-	// struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+func openDB(cfg config, tracer *tracing.Tracer) (*sql.DB, error) {
+	// Create a connector for the DSN from the config struct, and use sql.OpenDB() to
+	// create an empty connection pool with it. The connector is wrapped so that the
+	// queries made as part of a traced request get their own spans.
+	connector, err := pq.NewConnector(cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
 
+	db := sql.OpenDB(tracing.WrapConnector(connector, tracer))
+
 	// Set the maximum number of open (in-use + idle) connections in the pool. Note that
 	// passing a value less than or equal to 0 will mean there is no limit.
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.mazavrbazavr.ru/internal/mailer"
+	"greenlight.mazavrbazavr.ru/internal/metrics"
+)
+
+// Registers the metrics for the database connection pool, which are read from
+// db.Stats() whenever the metrics are scraped.
+func registerDBMetrics(registry *metrics.Registry, db *sql.DB) {
+	registry.NewGaugeFunc("greenlight_db_open_connections", "Number of established database connections, both in use and idle.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	registry.NewGaugeFunc("greenlight_db_in_use_connections", "Number of database connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	registry.NewGaugeFunc("greenlight_db_idle_connections", "Number of idle database connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	registry.NewGaugeFunc("greenlight_db_max_open_connections", "Maximum number of open database connections.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	registry.NewCounterFunc("greenlight_db_wait_count_total", "Total number of database connections waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	registry.NewCounterFunc("greenlight_db_wait_duration_seconds_total", "Total time spent waiting for a database connection.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	registry.NewCounterFunc("greenlight_db_max_idle_time_closed_total", "Total number of database connections closed due to the maximum idle time.", func() float64 {
+		return float64(db.Stats().MaxIdleTimeClosed)
+	})
+}
+
+// instrumentedMailer wraps a Mailer to count the emails sent through it, by template
+// and result ("success" or "failure").
+type instrumentedMailer struct {
+	mailer.Mailer
+	sent *metrics.CounterVec
+}
+
+func newInstrumentedMailer(m mailer.Mailer, registry *metrics.Registry) *instrumentedMailer {
+	return &instrumentedMailer{
+		Mailer: m,
+		sent:   registry.NewCounterVec("greenlight_emails_sent_total", "Total number of emails sent, by template and result.", "template", "result"),
+	}
+}
+
+func (m *instrumentedMailer) Send(recipient, locale, templateFile string, data any) error {
+	err := m.Mailer.Send(recipient, locale, templateFile, data)
+	if err != nil {
+		m.sent.Inc(templateFile, "failure")
+		return err
+	}
+
+	m.sent.Inc(templateFile, "success")
+	return nil
+}
+
+// Returns the route pattern which handled the request (e.g. "/v1/movies/:id") for use
+// as a metric label. Labelling by the raw path would create a separate series for
+// every movie ID. Requests which didn't match any route are labelled "unmatched".
+//
+// The routes on the http.ServeMux set r.Pattern (to e.g. "GET /v1/movies/suggest").
+// httprouter doesn't record the pattern, so for its routes we look the path up again
+// and replace the values of the parameters in the path with their names.
+func routePattern(r *http.Request, router *httprouter.Router) string {
+	if r.Pattern != "" && r.Pattern != "/" {
+		if _, pattern, found := strings.Cut(r.Pattern, " "); found {
+			return pattern
+		}
+		return r.Pattern
+	}
+
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+
+	i := 0
+	for _, param := range params {
+		for ; i < len(segments); i++ {
+			if segments[i] == param.Value {
+				segments[i] = ":" + param.Key
+				i++
+				break
+			}
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Returns the request method for use as a metric label. Non-standard methods are
+// labelled "OTHER", so that clients can't create any number of series.
+func routeMethod(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return r.Method
+	default:
+		return "OTHER"
+	}
+}
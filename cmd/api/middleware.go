@@ -26,9 +26,12 @@ import (
 	"time"
 
 	"github.com/felixge/httpsnoop"
+	"github.com/julienschmidt/httprouter"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/metrics"
+	"greenlight.mazavrbazavr.ru/internal/tracing"
 	"greenlight.mazavrbazavr.ru/internal/validator"
 )
 
@@ -59,8 +62,29 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-// Middleware to enforce an IP-based rate limit.
+// Middleware to enforce the general IP-based rate limit, which applies to most of the
+// endpoints.
 func (app *application) rateLimit(next http.Handler) http.Handler {
+	return app.limitByIP(func() (float64, int) {
+		cfg := app.currentConfig()
+		return cfg.limiter.rps, cfg.limiter.burst
+	}, next)
+}
+
+// Middleware to enforce the IP-based rate limit for the title suggestions endpoint.
+// Suggestions are requested on every keystroke, so they get their own bucket with
+// separate settings rather than eating into the general one.
+func (app *application) suggestRateLimit(next http.Handler) http.Handler {
+	return app.limitByIP(func() (float64, int) {
+		cfg := app.currentConfig()
+		return cfg.limiter.suggest.rps, cfg.limiter.suggest.burst
+	}, next)
+}
+
+// Returns a middleware which enforces an IP-based rate limit. Every call creates
+// a separate set of per-client limiters (a 'bucket'), with the requests-per-second and
+// burst values returned by the settings function.
+func (app *application) limitByIP(settings func() (float64, int), next http.Handler) http.Handler {
 	// Define a client struct to hold the rate limiter and last seen time for each
 	// client.
 	type client struct {
@@ -101,7 +125,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	// The function we are returning is a closure.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only carry out the check if rate limiting is enabled.
-		if app.config.limiter.enabled {
+		if app.currentConfig().limiter.enabled {
 			// Use the realip.FromRequest() function to get the client's real IP address.
 			ip := realip.FromRequest(r)
 
@@ -112,14 +136,25 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			// then initialize a new rate limiter which allows an average of 2 requests
 			// per second, with a maximum of 4 requests in a single ‘burst’, and add
 			// the IP address and limiter to the map.
+			rps, burst := settings()
+
 			if _, found := clients[ip]; !found {
 				// Create and add a new client struct to the map if it doesn't exist.
-				// Use the requests-per-second and burst values from the config struct.
+				// Use the requests-per-second and burst values from the settings.
 				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+					limiter: rate.NewLimiter(rate.Limit(rps), burst),
 				}
 			}
 
+			// If the settings have been changed by a configuration reload since the
+			// client's limiter was created, bring it up to date.
+			if clients[ip].limiter.Limit() != rate.Limit(rps) {
+				clients[ip].limiter.SetLimit(rate.Limit(rps))
+			}
+			if clients[ip].limiter.Burst() != burst {
+				clients[ip].limiter.SetBurst(burst)
+			}
+
 			// Update the last seen time for the client.
 			clients[ip].lastSeen = time.Now()
 
@@ -194,7 +229,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: We are using ScopeAuthentication
 		// as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.modelsFor(r).Users.GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -264,7 +299,7 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		user := app.contextGetUser(r)
 
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -299,17 +334,22 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 		// Only run this if there's an Origin request header present.
 		if origin != "" {
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
+			trustedOrigins := app.currentConfig().cors.trustedOrigins
+
+			for i := range trustedOrigins {
+				if origin == trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 
+					// Let the browser scripts read the request ID from the response.
+					w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
 					// it as a preflight request.
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						// Set the necessary preflight response headers.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
 
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
@@ -328,13 +368,23 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 }
 
 // Metrics middleware
-func (app *application) metrics(next http.Handler) http.Handler {
+func (app *application) metrics(router *httprouter.Router, next http.Handler) http.Handler {
 	// Initialize the new expvar variables when the middleware chain is first built.
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
 	totalResponsesSent := expvar.NewInt("total_responses_sent")
 	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 
+	// Register the request duration histogram for the /metrics endpoint. Unlike the
+	// expvar totals, this lets us calculate latency percentiles, broken down by method,
+	// route and status code.
+	requestDuration := app.registry.NewHistogramVec(
+		"greenlight_http_request_duration_seconds",
+		"Duration of HTTP requests, by method, route pattern and status code.",
+		metrics.DefaultBuckets,
+		"method", "route", "status",
+	)
+
 	// The following code will be run for every request...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Use the Add() method to increment the number of requests received by 1.
@@ -356,5 +406,98 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// The expvar map is string-keyed, so we need to use the strconv.Itoa()
 		// function to convert the status code (which is an integer) to a string.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		requestDuration.Observe(metrics.Duration.Seconds(), routeMethod(r), routePattern(r, router), strconv.Itoa(metrics.Code))
+	})
+}
+
+// Tracing middleware. This starts a span for the request, which continues the caller's
+// trace if the request has a traceparent header, and puts it in the request context so
+// that the spans for the database queries made by the handler become its children.
+// The span is named after the method and route pattern (e.g. "GET /v1/movies/:id"),
+// which is only known once the request has been routed.
+//
+// No middleware between this and the http.ServeMux may replace the request: this one
+// replaces it with a copy carrying the new context, and the http.ServeMux records the
+// route pattern on the request it is given, which must be the same one that this and
+// the metrics middleware look at.
+func (app *application) trace(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), r.Header)
+
+		ctx, span := app.tracer.Start(ctx, r.Method, tracing.KindServer,
+			tracing.String("http.request.method", r.Method),
+			tracing.String("url.path", r.URL.Path),
+			tracing.String("user_agent.original", r.UserAgent()),
+			tracing.String("http.request.id", app.contextGetRequestID(r)),
+		)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		r = r.WithContext(ctx)
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		route := routePattern(r, router)
+
+		span.SetName(routeMethod(r) + " " + route)
+		span.SetAttributes(
+			tracing.String("http.route", route),
+			tracing.Int("http.response.status_code", metrics.Code),
+		)
+
+		// Only server errors mark the span as failed; client errors are the client's
+		// problem, not ours.
+		if metrics.Code >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", metrics.Code, http.StatusText(metrics.Code)))
+		}
+	})
+}
+
+// Request ID middleware. This gives each request an ID, which is echoed in the
+// X-Request-ID response header, included in error responses and in every log entry
+// about the request, so that they can all be tied together. A request ID sent by the
+// client (or a proxy in front of us) is used if it looks sensible; otherwise a random
+// one is generated.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !validRequestID(id) {
+			var err error
+
+			id, err = newRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestInfo(r, &requestInfo{id: id})
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Access log middleware. This writes one log entry for each request once it has been
+// handled, with the response status and size, how long it took, the authenticated
+// user (if any) and the client's IP address.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		app.loggerFor(r).PrintInfo("request", map[string]any{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"status":         metrics.Code,
+			"bytes":          metrics.Written,
+			"duration_ms":    float64(metrics.Duration.Microseconds()) / 1000,
+			"client_ip":      realip.FromRequest(r),
+		})
 	})
 }
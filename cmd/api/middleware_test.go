@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.mazavrbazavr.ru/internal/tracing"
+)
+
+// A fake OpenTelemetry collector, which decodes the OTLP JSON requests sent by the
+// exporter and keeps the spans.
+type fakeCollector struct {
+	mu    sync.Mutex
+	spans []otlpTestSpan
+}
+
+type otlpTestSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpTestSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rs := range body.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestTraceSpanAndPropagation(t *testing.T) {
+	collector := &fakeCollector{}
+
+	ts := httptest.NewServer(collector)
+	defer ts.Close()
+
+	exporter := tracing.NewExporter(ts.URL, nil, "greenlight", "test", func(err error) {
+		t.Errorf("exporting spans: %v", err)
+	})
+
+	app := &application{tracer: tracing.New(exporter, 1)}
+
+	// The handler makes an outgoing request, for which it injects the traceparent
+	// header from the request context (as the webhook deliveries do).
+	outgoing := make(http.Header)
+
+	router := httprouter.New()
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", func(w http.ResponseWriter, r *http.Request) {
+		tracing.Inject(r.Context(), outgoing)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	const (
+		callerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		callerSpanID  = "00f067aa0ba902b7"
+	)
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies/42", nil)
+	r.Header.Set("traceparent", "00-"+callerTraceID+"-"+callerSpanID+"-01")
+
+	app.trace(router, router).ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusNoContent)
+	}
+
+	err := exporter.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	if len(collector.spans) != 1 {
+		t.Fatalf("got %d spans; want 1", len(collector.spans))
+	}
+
+	span := collector.spans[0]
+
+	if span.Name != "GET /v1/movies/:id" {
+		t.Errorf("got span name %q; want %q", span.Name, "GET /v1/movies/:id")
+	}
+	if span.TraceID != callerTraceID {
+		t.Errorf("got trace ID %q; want the caller's %q", span.TraceID, callerTraceID)
+	}
+	if span.ParentSpanID != callerSpanID {
+		t.Errorf("got parent span ID %q; want the caller's %q", span.ParentSpanID, callerSpanID)
+	}
+	if span.Kind != int(tracing.KindServer) {
+		t.Errorf("got span kind %d; want %d", span.Kind, tracing.KindServer)
+	}
+
+	want := "00-" + callerTraceID + "-" + span.SpanID + "-01"
+	if got := outgoing.Get("traceparent"); got != want {
+		t.Errorf("got outgoing traceparent %q; want %q", got, want)
+	}
+}
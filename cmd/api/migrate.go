@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/migrate"
+)
+
+// How long the server waits, at startup, for the check of the database schema.
+const schemaCheckTimeout = 10 * time.Second
+
+const migrateUsage = `usage: api [flags] migrate <command>
+
+commands:
+  up             apply all the pending migrations
+  down [n]       revert the latest n migrations (default 1)
+  status         show the status of each migration
+  goto <version> migrate up or down to the version (0 reverts all migrations)`
+
+// Runs the "migrate" subcommand with its arguments (after "migrate"), writing its
+// output to out. The migrations are embedded in the binary, so nothing else needs to
+// be deployed alongside it to migrate the database.
+func runMigrate(m *migrate.Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	// Migrations can take a while, and waiting for the lock held by another instance
+	// can take as long, so there is no timeout here.
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return errors.New(migrateUsage)
+		}
+
+		done, err := m.Up(ctx)
+		printMigrations(out, "applied", done)
+		return err
+
+	case "down":
+		n := 1
+
+		switch len(args) {
+		case 1:
+		case 2:
+			var err error
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		default:
+			return errors.New(migrateUsage)
+		}
+
+		done, err := m.Down(ctx, n)
+		printMigrations(out, "reverted", done)
+		return err
+
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+
+		done, err := m.Goto(ctx, version)
+		printMigrations(out, "migrated", done)
+		return err
+
+	case "status":
+		if len(args) != 1 {
+			return errors.New(migrateUsage)
+		}
+
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+
+		for _, s := range statuses {
+			appliedAt := "-"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Name, s.State, appliedAt)
+		}
+
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unknown migrate command %q\n\n%s", args[0], migrateUsage)
+	}
+}
+
+// Prints the migrations which were applied or reverted, or that there was nothing to
+// do.
+func printMigrations(out io.Writer, verb string, migrations []migrate.Migration) {
+	if len(migrations) == 0 {
+		fmt.Fprintln(out, "no change")
+		return
+	}
+
+	for _, mig := range migrations {
+		fmt.Fprintf(out, "%s %d (%s)\n", verb, mig.Version, mig.Name)
+	}
+}
+
+// Checks that the database schema is up to date, so that the server doesn't start
+// against a schema it doesn't match.
+func checkSchema(m *migrate.Migrator) error {
+	ctx, cancel := context.WithTimeout(context.Background(), schemaCheckTimeout)
+	defer cancel()
+
+	_, err := m.Check(ctx)
+	if errors.Is(err, migrate.ErrBehind) {
+		return fmt.Errorf("%w (run \"api migrate up\" to apply them)", err)
+	}
+
+	return err
+}
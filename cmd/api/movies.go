@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"greenlight.mazavrbazavr.ru/internal/data"
 	"greenlight.mazavrbazavr.ru/internal/validator"
@@ -57,12 +59,15 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err = app.modelsFor(r).Movies.Insert(movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	// Let the webhooks subscribed to the event know about the new movie.
+	app.emitEvent(data.EventMovieCreated, movie)
+
 	// When sending an HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at. We make an
 	// empty http.Header map and then use the Set() method to add a new Location header,
@@ -89,7 +94,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -121,7 +126,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -183,7 +188,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Pass the updated movie record to our new Update() method.
 	// Specifically check for an edit conflicts.
-	err = app.models.Movies.Update(movie)
+	err = app.modelsFor(r).Movies.Update(movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -194,6 +199,8 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.emitEvent(data.EventMovieUpdated, movie)
+
 	// Write the updated movie record in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
@@ -212,7 +219,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.modelsFor(r).Movies.Delete(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -223,6 +230,8 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.emitEvent(data.EventMovieDeleted, map[string]int64{"id": id})
+
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -236,8 +245,8 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// to hold the expected values from the request query string, embedding
 	// the filters struct.
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieFilters
+		Facets []string
 		data.Filters
 	}
 
@@ -247,11 +256,12 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Call r.URL.Query() to get the url.Values map containing the query string data.
 	qs := r.URL.Query()
 
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to defaults of an empty string and an empty slice respectively if they are not
-	// provided by the client.
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	// Read the conditions which narrow down the list of movies.
+	input.MovieFilters = app.readMovieFilters(qs, v)
+
+	// Read the optional list of facets (e.g. "facets=genres,decade") for which the
+	// client wants the per-value counts returned alongside the movies.
+	input.Facets = app.readCSV(qs, "facets", []string{})
 
 	// Get the page and page_size query string values as integers. Notice that we set
 	// the default page value to 1 and default page_size to 20, and that we pass the
@@ -259,29 +269,121 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
+	// Alternatively, the client can use keyset pagination by passing back one of the
+	// cursors from the metadata of a previous response. Deep pages are much faster
+	// this way. Counting the total number of records is just as slow as deep offsets,
+	// so we only do it by default for page-based pagination.
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.IncludeTotal = app.readBool(qs, "include_total", input.Filters.Cursor == "", v)
+
 	// Extract the sort query string value, falling back to "id" if it is not provided
 	// by the client (which will imply a ascending sort on movie ID).
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// The "relevance" sort always puts the best matches for the title filter first.
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "relevance", "-id", "-title", "-year", "-runtime"}
 
 	// Execute the validation checks on the Filters struct and send a response
 	// containing the errors if necessary.
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	data.ValidateMovieFilters(v, input.MovieFilters)
+	data.ValidateFilters(v, input.Filters)
+	data.ValidateFacets(v, input.Facets)
+
+	// Sorting by relevance only makes sense if there is a title to be relevant to.
+	if input.Filters.Sort == "relevance" {
+		v.Check(input.MovieFilters.Title != "", "sort", "relevance sort requires a title filter")
+		v.Check(input.Filters.Cursor == "", "cursor", "must not be used with relevance sort")
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.modelsFor(r).Movies.GetAll(input.MovieFilters, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	env := envelope{"movies": movies, "metadata": metadata}
+
+	// Facets are opt-in, so we only run the companion query (and only include the
+	// "facets" key in the response) if the client asked for at least one of them.
+	if len(input.Facets) > 0 {
+		facets, err := app.modelsFor(r).Movies.GetFacets(input.MovieFilters, input.Facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["facets"] = facets
+	}
+
 	// Send a JSON response containing the movie data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// A helper that reads the movie filter parameters from the query string (qs). Any
+// parameters which are not provided by the client are left at their zero values, which
+// means that the corresponding filter isn't applied.
+func (app *application) readMovieFilters(qs url.Values, v *validator.Validator) data.MovieFilters {
+	return data.MovieFilters{
+		// Use our helpers to extract the title and genres query string values, falling
+		// back to defaults of an empty string and an empty slice respectively if they
+		// are not provided by the client.
+		Title:         app.readString(qs, "title", ""),
+		Genres:        app.readCSV(qs, "genres", []string{}),
+		GenresAny:     app.readCSV(qs, "genres_any", []string{}),
+		GenresExclude: app.readCSV(qs, "genres_exclude", []string{}),
+		YearMin:       app.readInt(qs, "year_min", 0, v),
+		YearMax:       app.readInt(qs, "year_max", 0, v),
+		RuntimeMin:    app.readInt(qs, "runtime_min", 0, v),
+		RuntimeMax:    app.readInt(qs, "runtime_max", 0, v),
+		CreatedSince:  app.readTime(qs, "created_since", time.Time{}, v),
+	}
+}
+
+// Handler for the "GET /v1/movies/suggest" endpoint, which returns title suggestions for
+// a search box as the user types. Method of the application struct.
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	// Read the (possibly partial) query and the maximum number of suggestions to
+	// return, defaulting to 10.
+	query := app.readString(qs, "q", "")
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(query != "", "q", "must be provided")
+	v.Check(len(query) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.modelsFor(r).Movies.Suggest(query, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The same prefix tends to be requested over and over again while the user is
+	// typing (and when they delete characters), so we let the client cache the
+	// response for a short while. It is marked as private because the endpoint
+	// requires authentication.
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "private, max-age=60")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
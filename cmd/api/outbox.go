@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// How long the outbox worker can take to deliver an email before it is considered
+// abandoned and picked up again, and the limits for the exponential back-off between
+// delivery attempts.
+const (
+	outboxLease          = time.Minute
+	outboxRetryBaseDelay = 30 * time.Second
+	outboxRetryMaxDelay  = 6 * time.Hour
+)
+
+// Starts the worker which delivers the emails in the outbox, in the background. Like
+// the job workers, it stops once the done channel is closed (after finishing the email
+// it is sending), and is tracked by the app.wg WaitGroup.
+func (app *application) startOutboxWorker(done <-chan struct{}) {
+	app.background(func() {
+		for {
+			// Keep sending emails for as long as there are any due, then wait for the
+			// poll interval before checking again, unless we're shutting down.
+			sent := app.sendNextEmail()
+
+			if !sent {
+				select {
+				case <-done:
+					return
+				case <-time.After(app.config.outbox.pollInterval):
+				}
+			}
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	})
+}
+
+// Claims the next email in the outbox which is due and tries to deliver it, recording
+// the outcome in the database. Returns whether an email was claimed.
+func (app *application) sendNextEmail() bool {
+	email, err := app.models.Outbox.Claim(outboxLease, app.config.outbox.maxAttempts)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.PrintError(err, nil)
+		}
+		return false
+	}
+
+	logger := app.logger.With(map[string]any{
+		"email_id": email.ID,
+		"template": email.Template,
+		"attempt":  email.Attempts,
+	})
+
+	err = app.mailer.Send(email.Recipient, email.Locale, email.Template, email.Data)
+	if err != nil {
+		// A failed attempt is only a warning if the email will be retried.
+		if email.Attempts < app.config.outbox.maxAttempts {
+			logger.PrintWarn("email delivery attempt failed", map[string]any{"error": err})
+		} else {
+			logger.PrintError(err, nil)
+		}
+
+		delay := retryDelay(email.Attempts, outboxRetryBaseDelay, outboxRetryMaxDelay)
+
+		err = app.models.Outbox.MarkFailed(email, err, app.config.outbox.maxAttempts, delay)
+		if err != nil {
+			logger.PrintError(err, nil)
+		}
+		return true
+	}
+
+	err = app.models.Outbox.MarkSent(email)
+	if err != nil {
+		logger.PrintError(err, nil)
+		return true
+	}
+
+	logger.PrintDebug("email delivered", nil)
+
+	return true
+}
+
+// Handler for the "GET /v1/admin/emails" endpoint, which lets administrators check on
+// the delivery of outgoing emails, optionally filtered by status.
+func (app *application) listEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// The newest emails are shown first by default.
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "next_attempt_at", "attempts", "-id", "-next_attempt_at", "-attempts"}
+
+	data.ValidateEmailStatus(v, input.Status)
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emails, metadata, err := app.modelsFor(r).Outbox.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emails": emails, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
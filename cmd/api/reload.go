@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"greenlight.mazavrbazavr.ru/internal/mailer"
+)
+
+// Reports whether the setting with the given flag name can be changed by reloading the
+// configuration: the CORS trusted origins, the rate limiter settings, the log level and
+// the mailer settings. The other settings only take effect on a restart.
+func isReloadable(name string) bool {
+	switch {
+	case name == "log-level":
+		return true
+	case strings.HasPrefix(name, "cors-"), strings.HasPrefix(name, "limiter-"):
+		return true
+	case strings.HasPrefix(name, "mailer-"), strings.HasPrefix(name, "smtp-"):
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the current configuration. It differs from app.config, which is the
+// configuration the server started with, in the reloadable settings, so those must be
+// read through this method.
+func (app *application) currentConfig() *config {
+	return app.current.Load()
+}
+
+// Reloads the configuration, on SIGHUP, by loading it again from the command-line flags
+// and environment (those of the process, other than in the tests) and the configuration
+// file, and swapping in the reloadable settings. The changes are logged, along with any
+// changes to settings which aren't reloadable (and so are ignored until a restart). If
+// the new configuration can't be loaded or is invalid, or the new mailer can't be
+// created, the reload is rejected and the server carries on with the current
+// configuration.
+//
+// The log level is only changed if the log-level setting itself has changed, so that
+// a level set with the "PUT /v1/admin/log-level" endpoint isn't undone by an unrelated
+// reload.
+func (app *application) reloadConfig(args []string, lookupEnv func(string) (string, bool)) error {
+	loaded, err := loadConfig(args, lookupEnv)
+	if err != nil {
+		return err
+	}
+
+	if errs := loaded.cfg.validate(); len(errs) > 0 {
+		var b strings.Builder
+
+		b.WriteString("invalid configuration:")
+		for _, key := range slices.Sorted(maps.Keys(errs)) {
+			fmt.Fprintf(&b, " -%s: %s;", key, errs[key])
+		}
+
+		return errors.New(strings.TrimSuffix(b.String(), ";"))
+	}
+
+	changed, ignored := diffConfig(app.loaded.flags, loaded.flags)
+
+	if len(changed) == 0 && len(ignored) == 0 {
+		app.logger.PrintInfo("configuration reloaded without changes", nil)
+		return nil
+	}
+
+	// Create the new mailer (if its settings have changed) before changing anything, so
+	// that a failure leaves the server as it was.
+	var m mailer.Mailer
+
+	if hasPrefix(changed, "mailer-", "smtp-") {
+		m, err = newMailer(loaded.cfg, app.logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	next := *app.currentConfig()
+	next.cors = loaded.cfg.cors
+	next.limiter = loaded.cfg.limiter
+	next.log.level = loaded.cfg.log.level
+	next.mailer = loaded.cfg.mailer
+	next.smtp = loaded.cfg.smtp
+
+	app.current.Store(&next)
+
+	if m != nil {
+		app.swappableMailer.swap(m)
+	}
+
+	app.loaded = loaded
+
+	app.logger.PrintInfo("configuration reloaded", map[string]any{"changed": changed})
+
+	if len(ignored) > 0 {
+		app.logger.PrintWarn("changed settings ignored until restart", map[string]any{"ignored": ignored})
+	}
+
+	// Change the log level after logging the reload, so that raising it doesn't hide
+	// the entry for the reload which raised it.
+	if _, ok := changed["log-level"]; ok {
+		app.logger.SetLevel(loaded.cfg.log.level)
+	}
+
+	return nil
+}
+
+// A changed setting, with its old and new values (with the secrets masked).
+type settingChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Compares the settings of the old and new flag sets, and returns the changes to the
+// reloadable settings and to the others, keyed by flag name.
+func diffConfig(old, new *flag.FlagSet) (changed, ignored map[string]settingChange) {
+	changed = make(map[string]settingChange)
+	ignored = make(map[string]settingChange)
+
+	new.VisitAll(func(f *flag.Flag) {
+		if commandLineOnly[f.Name] {
+			return
+		}
+
+		oldValue := displayConfigValue(old.Lookup(f.Name))
+		newValue := displayConfigValue(f)
+
+		if oldValue == newValue {
+			return
+		}
+
+		change := settingChange{Old: oldValue, New: newValue}
+
+		if isReloadable(f.Name) {
+			changed[f.Name] = change
+		} else {
+			ignored[f.Name] = change
+		}
+	})
+
+	return changed, ignored
+}
+
+// Returns the value of the flag as text, masking it if it's a secret.
+func displayConfigValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if secretSettings[f.Name] && value != "" {
+		return maskSecret(f.Name, value)
+	}
+	return value
+}
+
+// Reports whether any of the keys of the map has one of the prefixes.
+func hasPrefix(m map[string]settingChange, prefixes ...string) bool {
+	for key := range m {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// swappableMailer is a Mailer which passes the emails on to another Mailer, which can be
+// swapped for a new one (when the mailer settings are reloaded) while emails are being
+// sent. The emails already being sent with the previous one carry on with it.
+type swappableMailer struct {
+	current atomic.Pointer[mailer.Mailer]
+}
+
+func newSwappableMailer(m mailer.Mailer) *swappableMailer {
+	s := &swappableMailer{}
+	s.swap(m)
+	return s
+}
+
+func (s *swappableMailer) swap(m mailer.Mailer) {
+	s.current.Store(&m)
+}
+
+func (s *swappableMailer) Send(recipient, locale, templateFile string, data any) error {
+	return (*s.current.Load()).Send(recipient, locale, templateFile, data)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+	"greenlight.mazavrbazavr.ru/internal/mailer"
+)
+
+// A mailer which records the emails sent with it. If release is set, each Send()
+// signals on sending and then waits for release, so that a test can swap the mailer
+// while an email is being sent.
+type fakeMailer struct {
+	sending chan struct{}
+	release chan struct{}
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func (m *fakeMailer) Send(recipient, locale, templateFile string, data any) error {
+	if m.release != nil {
+		m.sending <- struct{}{}
+		<-m.release
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, recipient)
+	return nil
+}
+
+// The environment of the test application, for loadConfig(). The rate limiter allows one
+// request, and then none for a very long time.
+var testEnv = map[string]string{
+	"GREENLIGHT_DB_DSN":        "postgres://greenlight@localhost/greenlight",
+	"GREENLIGHT_LIMITER_RPS":   "0.001",
+	"GREENLIGHT_LIMITER_BURST": "1",
+}
+
+// Returns the environment of the test application with the changes made.
+func changedEnv(changes map[string]string) map[string]string {
+	env := maps.Clone(testEnv)
+	maps.Copy(env, changes)
+	return env
+}
+
+// Returns an application with the configuration loaded from the environment and the
+// fake mailer, which writes its log to the buffer.
+func newReloadTestApp(t *testing.T, env map[string]string, m *fakeMailer, log *bytes.Buffer) *application {
+	t.Helper()
+
+	loaded, err := loadConfig(nil, fakeEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		config:          loaded.cfg,
+		loaded:          loaded,
+		logger:          jsonlog.New(log, jsonlog.LevelInfo),
+		swappableMailer: newSwappableMailer(m),
+	}
+
+	cfg := loaded.cfg
+	app.current.Store(&cfg)
+
+	return app
+}
+
+func TestReloadConfig(t *testing.T) {
+	var log bytes.Buffer
+
+	previous := &fakeMailer{}
+	app := newReloadTestApp(t, testEnv, previous, &log)
+	swappable := app.swappableMailer.current.Load()
+
+	env := changedEnv(map[string]string{
+		"GREENLIGHT_CORS_TRUSTED_ORIGINS": "https://greenlight.example.com",
+		"GREENLIGHT_LIMITER_RPS":          "50",
+		"GREENLIGHT_LOG_LEVEL":            "warn",
+		"GREENLIGHT_MAILER_SENDER":        "Greenlight <greenlight@example.com>",
+		"GREENLIGHT_DB_MAX_OPEN_CONNS":    "50",
+	})
+
+	err := app.reloadConfig(nil, fakeEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := app.currentConfig()
+
+	if len(cfg.cors.trustedOrigins) != 1 || cfg.cors.trustedOrigins[0] != "https://greenlight.example.com" {
+		t.Errorf("got trusted origins %q; want the new one", cfg.cors.trustedOrigins)
+	}
+	if cfg.limiter.rps != 50 {
+		t.Errorf("got limiter rps %v; want 50", cfg.limiter.rps)
+	}
+	if cfg.mailer.sender != "Greenlight <greenlight@example.com>" {
+		t.Errorf("got mailer sender %q; want the new one", cfg.mailer.sender)
+	}
+	if app.logger.Level() != jsonlog.LevelWarn {
+		t.Errorf("got log level %s; want %s", app.logger.Level(), jsonlog.LevelWarn)
+	}
+
+	// The settings which aren't reloadable are left alone until a restart, and the
+	// configuration the server started with isn't changed.
+	if cfg.db.maxOpenConns != 25 {
+		t.Errorf("got db max open conns %d; want 25", cfg.db.maxOpenConns)
+	}
+	if app.config.limiter.rps != 0.001 {
+		t.Errorf("the configuration the server started with was changed")
+	}
+
+	// The emails are sent with a mailer for the new settings.
+	if app.swappableMailer.current.Load() == swappable {
+		t.Errorf("the mailer wasn't swapped")
+	}
+
+	for _, want := range []string{`"message":"configuration reloaded"`, `"limiter-rps":{"old":"0.001","new":"50"}`} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("the log doesn't contain %s:\n%s", want, log.String())
+		}
+	}
+	if !strings.Contains(log.String(), `"db-max-open-conns":{"old":"25","new":"50"}`) {
+		t.Errorf("the ignored change wasn't logged:\n%s", log.String())
+	}
+}
+
+func TestReloadConfigRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+		wantErr string
+	}{
+		{
+			name:    "Unloadable",
+			changes: map[string]string{"GREENLIGHT_LIMITER_RPS": "fast"},
+			wantErr: "GREENLIGHT_LIMITER_RPS: invalid value for -limiter-rps",
+		},
+		{
+			name:    "Invalid",
+			changes: map[string]string{"GREENLIGHT_LIMITER_RPS": "0", "GREENLIGHT_CORS_TRUSTED_ORIGINS": "example.com"},
+			wantErr: "invalid configuration: -cors-trusted-origins: \"example.com\" is not an origin, like https://example.com; -limiter-rps: must be greater than zero",
+		},
+		{
+			name: "Mailer not created",
+			changes: map[string]string{
+				"GREENLIGHT_MAILER_TRANSPORT": "file",
+				"GREENLIGHT_MAILER_DIR":       filepath.Join(writeTempFile(t, "not-a-dir", ""), "mail"),
+			},
+			wantErr: "not a directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+
+			previous := &fakeMailer{}
+			app := newReloadTestApp(t, testEnv, previous, &log)
+
+			cfg := app.currentConfig()
+			loaded := app.loaded
+
+			err := app.reloadConfig(nil, fakeEnv(changedEnv(tt.changes)))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v; want one containing %q", err, tt.wantErr)
+			}
+
+			if app.currentConfig() != cfg || app.currentConfig().limiter.rps != 0.001 {
+				t.Errorf("the current configuration was changed")
+			}
+			if app.loaded != loaded {
+				t.Errorf("the loaded configuration was changed")
+			}
+			if *app.swappableMailer.current.Load() != mailer.Mailer(previous) {
+				t.Errorf("the mailer was swapped")
+			}
+
+			// The next reload is still compared with the configuration the server has.
+			err = app.reloadConfig(nil, fakeEnv(testEnv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(log.String(), "configuration reloaded without changes") {
+				t.Errorf("the log doesn't show a reload without changes:\n%s", log.String())
+			}
+		})
+	}
+}
+
+func TestReloadConfigRateLimit(t *testing.T) {
+	var log bytes.Buffer
+
+	app := newReloadTestApp(t, testEnv, &fakeMailer{}, &log)
+
+	handler := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	get := func() int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+		return rr.Code
+	}
+
+	// The client uses up its burst of one request, which isn't refilled for a very long
+	// time.
+	if code := get(); code != http.StatusNoContent {
+		t.Fatalf("got status %d for the first request; want %d", code, http.StatusNoContent)
+	}
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d for the second request; want %d", code, http.StatusTooManyRequests)
+	}
+
+	err := app.reloadConfig(nil, fakeEnv(changedEnv(map[string]string{
+		"GREENLIGHT_LIMITER_RPS":   "50",
+		"GREENLIGHT_LIMITER_BURST": "3",
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request brings the client's limiter up to date. After that, it refills at
+	// 50 requests a second up to the new burst, so that three requests in a row are
+	// allowed, but not a fourth.
+	get()
+	time.Sleep(200 * time.Millisecond)
+
+	var codes []int
+	for range 4 {
+		codes = append(codes, get())
+	}
+
+	want := []int{http.StatusNoContent, http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests}
+
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("got statuses %v after the reload; want %v", codes, want)
+		}
+	}
+}
+
+func TestSwappableMailer(t *testing.T) {
+	previous := &fakeMailer{sending: make(chan struct{}), release: make(chan struct{})}
+	next := &fakeMailer{}
+
+	s := newSwappableMailer(previous)
+
+	// Start sending an email with the previous mailer, and swap it while it's sending.
+	// The swap doesn't wait for the email, and new emails go to the new mailer straight
+	// away.
+	sent := make(chan error)
+	go func() {
+		sent <- s.Send("alice@example.com", "en", "user_welcome.tmpl", nil)
+	}()
+	<-previous.sending
+
+	s.swap(next)
+
+	err := s.Send("bob@example.com", "en", "user_welcome.tmpl", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The email being sent with the previous mailer carries on with it.
+	close(previous.release)
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(previous.sent) != 1 || previous.sent[0] != "alice@example.com" {
+		t.Errorf("got %q sent with the previous mailer; want alice@example.com", previous.sent)
+	}
+	if len(next.sent) != 1 || next.sent[0] != "bob@example.com" {
+		t.Errorf("got %q sent with the new mailer; want bob@example.com", next.sent)
+	}
+}
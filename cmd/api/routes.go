@@ -24,12 +24,15 @@ func (app *application) routes() http.Handler {
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
 	// Register the relevant methods, URL patterns and handler functions for endpoints.
+	// The original healthcheck endpoint is kept, with its original response, for the
+	// clients which still use it. Like the liveness probe, it checks no dependencies.
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	// Handlers related to movies are wrapped by the corresponding Permission
 	// middlewares.
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/import", app.requirePermission("movies:write", app.importMoviesHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
@@ -37,19 +40,57 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
+	router.HandlerFunc(http.MethodGet, "/v1/jobs/:id", app.requireActivatedUser(app.showJobHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/emails", app.requirePermission("admin:read", app.listEmailsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/emails/templates", app.requirePermission("admin:read", app.listEmailTemplatesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/emails/preview", app.requirePermission("admin:write", app.previewEmailHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/log-level", app.requirePermission("admin:read", app.showLogLevelHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/log-level", app.requirePermission("admin:write", app.updateLogLevelHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requirePermission("admin:read", app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requirePermission("admin:write", app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requirePermission("admin:read", app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requirePermission("admin:write", app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requirePermission("admin:write", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission("admin:read", app.listWebhookDeliveriesHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.Handler(http.MethodGet, "/metrics", app.registry.Handler())
+
+	// httprouter doesn't allow a static path segment in the same position as
+	// a wildcard for the same method (e.g. GET /v1/movies/suggest alongside
+	// GET /v1/movies/:id), so such routes are registered on a standard library
+	// http.ServeMux which sits in front of the router and passes everything else
+	// through to it. This also lets these routes have their own middleware chains.
+	mux := http.NewServeMux()
+
+	// The health endpoints are probed by load balancers and orchestrators, so they are
+	// neither rate limited nor authenticated.
+	mux.HandleFunc("GET /v1/healthz/live", app.livenessHandler)
+	mux.HandleFunc("GET /v1/healthz/ready", app.readinessHandler)
+
+	// The title suggestions use their own rate limit bucket instead of the general one.
+	mux.Handle("GET /v1/movies/suggest", app.suggestRateLimit(app.authenticate(app.requirePermission("movies:read", app.suggestMoviesHandler))))
+	mux.Handle("GET /v1/movies/export", app.rateLimit(app.authenticate(app.requirePermission("movies:read", app.exportMoviesHandler))))
+	mux.Handle("GET /v1/movies/events", app.rateLimit(app.authenticate(app.requirePermission("movies:read", app.movieEventsHandler))))
+
+	// Rate limit middleware - comes after our panic recovery middleware (so that any
+	// panics in rateLimit() are recovered), but otherwise we want it to be used as
+	// early as possible to prevent unnecessary work for our server. It's followed by
+	// the authentication middleware.
+	mux.Handle("/", app.rateLimit(app.authenticate(router)))
 
-	// Return the httprouter instance.
+	// Return the handler.
 	// Middlewares:
+	// - Request ID middleware;
+	// - Access log middleware;
+	// - Tracing middleware;
 	// - Metrics middleware;
 	// - Panic recovery middleware;
-	// - CORS middleware;
-	// - Rate limit middleware - comes after our panic recovery middleware (so that any
-	//   panics in rateLimit() are recovered), but otherwise we want it to be used as
-	//   early as possible to prevent unnecessary work for our server;
-	// - Authentication middleware.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// - CORS middleware.
+	return app.requestID(app.logRequest(app.trace(router, app.metrics(router, app.recoverPanic(app.enableCORS(mux))))))
 }
@@ -23,6 +23,37 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Start the background job workers. Closing the jobsDone channel tells them to stop
+	// picking up new jobs.
+	jobsDone := make(chan struct{})
+	app.startJobWorkers(jobsDone)
+
+	// Likewise, start the workers which deliver the emails in the outbox and the
+	// webhooks.
+	app.startOutboxWorker(jobsDone)
+	app.startWebhookWorker(jobsDone)
+
+	// Start listening for changes to the movies for the event streams. The broker is
+	// closed as soon as the shutdown starts, to end the open streams.
+	app.events = newChangeBroker()
+	app.startChangeListener(app.events)
+	srv.RegisterOnShutdown(app.events.close)
+
+	// Reload the configuration whenever a SIGHUP signal is received, until the server
+	// starts shutting down. A failed reload is logged, and the server carries on with
+	// the configuration it had.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	go func() {
+		for range reload {
+			err := app.reloadConfig(os.Args[1:], os.LookupEnv)
+			if err != nil {
+				app.logger.PrintError(fmt.Errorf("configuration reload rejected: %w", err), nil)
+			}
+		}
+	}()
+
 	// A shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
@@ -45,10 +76,20 @@ func (app *application) serve() error {
 		// Log a message to say that the the server is shutting down. Notice that we
 		// also call the String() method on the signal to get the signal name and
 		// include it in the log entry properties.
-		app.logger.PrintInfo("shutting down server", map[string]string{
+		app.logger.PrintInfo("shutting down server", map[string]any{
 			"signal": s.String(),
 		})
 
+		// Stop reloading the configuration. No more signals are sent on the channel
+		// after signal.Stop() returns, so it can be closed.
+		signal.Stop(reload)
+		close(reload)
+
+		// Report that we aren't ready any more, and give the load balancers a moment to
+		// notice and stop sending us new requests before the listeners are closed.
+		app.health.shuttingDown.Store(true)
+		time.Sleep(app.config.health.shutdownDelay)
+
 		// Create a context with a 20-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
@@ -64,9 +105,13 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		// Tell the job, outbox and webhook workers to stop once they have finished what
+		// they are doing.
+		close(jobsDone)
+
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
-		app.logger.PrintInfo("completing background tasks", map[string]string{
+		app.logger.PrintInfo("completing background tasks", map[string]any{
 			"addr": srv.Addr,
 		})
 
@@ -75,11 +120,23 @@ func (app *application) serve() error {
 		// the shutdownError channel, to indicate that the shutdown completed without
 		// any issues.
 		app.wg.Wait()
+
+		// Send the spans which haven't been exported yet to the trace collector. The
+		// shutdown context may have run out by now, as waiting for the background tasks
+		// isn't bounded by it, so this gets a few seconds of its own.
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+
+		err = app.tracer.Shutdown(flushCtx)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
 		shutdownError <- nil
 	}()
 
 	// Log a "starting server" message.
-	app.logger.PrintInfo("starting server", map[string]string{
+	app.logger.PrintInfo("starting server", map[string]any{
 		"addr": srv.Addr,
 		"env":  app.config.env,
 	})
@@ -105,7 +162,7 @@ func (app *application) serve() error {
 
 	// At this point we know that the graceful shutdown completed successfully and we
 	// log a "stopped server" message.
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", map[string]any{
 		"addr": srv.Addr,
 	})
 
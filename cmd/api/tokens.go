@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/tracing"
 	"greenlight.mazavrbazavr.ru/internal/validator"
 )
 
@@ -37,7 +38,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -48,8 +49,12 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	// Check if the provided password matches the actual password for the user.
+	// Check if the provided password matches the actual password for the user. This is
+	// deliberately slow, so it gets its own span in the request's trace.
+	_, span := app.tracer.Start(r.Context(), "bcrypt.compare", tracing.KindInternal)
 	match, err := user.Password.Matches(input.Password)
+	span.RecordError(err)
+	span.End()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -64,7 +69,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// Otherwise, if the password is correct, we generate a new token with a 24-hour
 	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.modelsFor(r).Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -100,7 +105,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 
 	// Try to retrieve the corresponding user record for the email address. If it can't
 	// be found, return an error message to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -119,28 +124,29 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	// Otherwise, create a new activation token.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	// Otherwise, create a new activation token and queue the email containing it in
+	// the outbox. Since email addresses MAY be case sensitive, notice that we are
+	// sending this email using the address stored in our database for the user --- not
+	// to the input.Email address provided by the client in this request.
+	ttl := 3 * 24 * time.Hour
+
+	_, err = app.modelsFor(r).Tokens.NewWithEmail(user.ID, ttl, data.ScopeActivation, func(token *data.Token) *data.Email {
+		return &data.Email{
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "token_activation.tmpl",
+			Data: map[string]any{
+				"activationToken":       token.Plaintext,
+				"activationTokenExpiry": token.Expiry,
+				"activationTokenTTL":    ttl.String(),
+			},
+		}
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Email the user with their additional activation token.
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-		}
-
-		// Since email addresses MAY be case sensitive, notice that we are sending this
-		// email using the address stored in our database for the user --- not to the
-		// input.Email address provided by the client in this request.
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
-
 	// Send a 202 Accepted response and confirmation message to the client.
 	env := envelope{
 		"message": "an email will be sent to you containing activation instructions",
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+	"greenlight.mazavrbazavr.ru/internal/mailer"
+	"greenlight.mazavrbazavr.ru/internal/tracing"
+)
+
+// Returns the tracer which exports spans to the configured OTLP endpoint, or nil (which
+// disables tracing) if no endpoint is configured.
+func newTracer(cfg config, logger *jsonlog.Logger) *tracing.Tracer {
+	if cfg.otel.endpoint == "" {
+		return nil
+	}
+
+	exporter := tracing.NewExporter(cfg.otel.endpoint, cfg.otel.headers, cfg.otel.serviceName, version, func(err error) {
+		logger.PrintError(err, map[string]any{"exporter": "otlp"})
+	})
+
+	return tracing.New(exporter, cfg.otel.sampleRatio)
+}
+
+// tracedMailer wraps a Mailer to create a span for each email sent through it. Emails
+// are sent by the outbox worker rather than during a request, so each send is the root
+// of its own trace.
+type tracedMailer struct {
+	mailer.Mailer
+	tracer *tracing.Tracer
+}
+
+func newTracedMailer(m mailer.Mailer, tracer *tracing.Tracer) mailer.Mailer {
+	if tracer == nil {
+		return m
+	}
+
+	return &tracedMailer{Mailer: m, tracer: tracer}
+}
+
+func (m *tracedMailer) Send(recipient, locale, templateFile string, data any) error {
+	_, span := m.tracer.Start(context.Background(), "mailer.Send", tracing.KindClient,
+		tracing.String("email.template", templateFile),
+		tracing.String("email.locale", locale),
+	)
+	defer span.End()
+
+	err := m.Mailer.Send(recipient, locale, templateFile, data)
+	span.RecordError(err)
+
+	return err
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/tracing"
 	"greenlight.mazavrbazavr.ru/internal/validator"
 )
 
@@ -16,6 +17,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 
 	// Parse the request body into the anonymous struct.
@@ -33,11 +35,22 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    input.Locale,
+	}
+
+	// If the client didn't choose a locale for the user, use the best match for their
+	// Accept-Language header. The locale is used for the emails we send to the user.
+	if user.Locale == "" {
+		user.Locale = app.readLocale(r)
 	}
 
 	// Use the Password.Set() method to generate and store the hashed and plaintext
-	// passwords.
+	// passwords. Like checking a password, this is deliberately slow, so it gets its
+	// own span in the request's trace.
+	_, span := app.tracer.Start(r.Context(), "bcrypt.hash", tracing.KindInternal)
 	err = user.Password.Set(input.Password)
+	span.RecordError(err)
+	span.End()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -52,8 +65,30 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// Register the user: this inserts the user record, grants them the "movies:read"
+	// permission, generates an activation token, and adds the welcome email to the
+	// outbox, all in a single transaction. The email is then delivered by the outbox
+	// worker, which retries it if the SMTP server is unavailable, so it isn't lost if
+	// sending fails or the application is restarted.
+	ttl := 3 * 24 * time.Hour
+
+	_, err = app.modelsFor(r).Users.Register(user, []string{"movies:read"}, ttl, func(token *data.Token) *data.Email {
+		// As there are multiple pieces of data that we want to pass to our email
+		// templates, we use a map to act as a 'holding structure' for the data. This
+		// contains the plaintext version of the activation token for the user, when it
+		// expires, along with their ID.
+		return &data.Email{
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "user_welcome.tmpl",
+			Data: map[string]any{
+				"activationToken":       token.Plaintext,
+				"activationTokenExpiry": token.Expiry,
+				"activationTokenTTL":    ttl.String(),
+				"userID":                user.ID,
+			},
+		}
+	})
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
@@ -68,51 +103,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// After the user record has been created in the database, generate a new activation
-	// token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Launch a goroutine which runs an anonymous function that sends the welcome email.
-	// The code in this background goroutine will be executed concurrently with the
-	// subsequent code in our registerUserHandler, which means we are not waiting for
-	// the email to be sent before we return a JSON response to the client. Most likely,
-	// the background goroutine will still be executing its code long after the
-	// registerUserHandler has returned. Use the background helper to execute an
-	// anonymous function that sends the welcome email.
-	app.background(func() {
-		// As there are now multiple pieces of data that we want to pass to our email
-		// templates, we create a map to act as a 'holding structure' for the data. This
-		// contains the plaintext version of the activation token for the user, along
-		// with their ID.
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		// Call the Send() method on our Mailer, passing in the user's email address,
-		// name of the template file, and the data with the user ID and activation token
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			// Importantly, if there is an error sending the email then we use the
-			// app.logger.PrintError() helper to manage it, instead of the
-			// app.serverErrorResponse() helper like before. This is because by the time
-			// we encounter the errors, the client will probably have already been sent
-			// a 202 Accepted response by our writeJSON() helper.
-			app.logger.PrintError(err, nil)
-		}
-	})
-
 	// Write a JSON response containing the user data along with a 202 Accepted status
 	// code. This status code indicates that the request has been accepted for
 	// processing, but the processing has not been completed.
@@ -145,7 +135,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	// Retrieve the details of the user associated with the token using the
 	// GetForToken() method. If no matching record is found, then we let the client know
 	// that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -162,7 +152,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Save the updated user record in our database, checking for any edit conflicts in
 	// the same way that we did for our movie records.
-	err = app.models.Users.Update(user)
+	err = app.modelsFor(r).Users.Update(user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -175,12 +165,14 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// If everything went successfully, then we delete all activation tokens for the
 	// user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.modelsFor(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.emitEvent(data.EventUserActivated, user)
+
 	// Send the updated user details to the client in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
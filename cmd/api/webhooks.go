@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// How long the webhook worker can take to make a delivery before it is considered
+// abandoned and picked up again, and the limits for the exponential back-off between
+// delivery attempts.
+const (
+	webhookLease          = time.Minute
+	webhookRetryBaseDelay = 30 * time.Second
+	webhookRetryMaxDelay  = 6 * time.Hour
+)
+
+// Queues deliveries of the event, one for each payload, to the webhooks subscribed to
+// it. This is called after the change that the event describes has been made, so a
+// failure here is logged rather than sent to the client.
+func (app *application) emitEvent(event string, payloads ...any) {
+	err := app.models.Webhooks.Enqueue(event, payloads...)
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{"event": event})
+	}
+}
+
+// Starts the worker which makes the webhook deliveries, in the background. Like the
+// outbox worker, it stops once the done channel is closed (after finishing the
+// delivery it is making), and is tracked by the app.wg WaitGroup.
+func (app *application) startWebhookWorker(done <-chan struct{}) {
+	// Redirects are not followed: the delivery has to be accepted by the URL the
+	// webhook was registered with.
+	client := &http.Client{
+		Timeout: app.config.webhooks.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	app.background(func() {
+		for {
+			delivered := app.deliverNextWebhook(client)
+
+			if !delivered {
+				select {
+				case <-done:
+					return
+				case <-time.After(app.config.webhooks.pollInterval):
+				}
+			}
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	})
+}
+
+// Claims the next webhook delivery which is due and makes it, recording the outcome in
+// the delivery log. Returns whether a delivery was claimed.
+func (app *application) deliverNextWebhook(client *http.Client) bool {
+	delivery, err := app.models.Webhooks.ClaimDelivery(webhookLease, app.config.webhooks.maxAttempts)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.PrintError(err, nil)
+		}
+		return false
+	}
+
+	logger := app.logger.With(map[string]any{
+		"delivery_id": delivery.ID,
+		"webhook_id":  delivery.WebhookID,
+		"event":       delivery.Event,
+		"attempt":     delivery.Attempts,
+	})
+
+	status, err := app.sendWebhook(client, delivery)
+	if err != nil {
+		// A failed attempt is only a warning if the delivery will be retried.
+		if delivery.Attempts < app.config.webhooks.maxAttempts {
+			logger.PrintWarn("webhook delivery attempt failed", map[string]any{"error": err, "status": status})
+		} else {
+			logger.PrintError(err, map[string]any{"status": status})
+		}
+
+		delay := retryDelay(delivery.Attempts, webhookRetryBaseDelay, webhookRetryMaxDelay)
+
+		err = app.models.Webhooks.MarkFailed(delivery, status, err, app.config.webhooks.maxAttempts, delay)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			logger.PrintWarn("webhook delivery lease lost", nil)
+		case err != nil:
+			logger.PrintError(err, nil)
+		}
+		return true
+	}
+
+	// If the lease on the delivery ran out while we were sending it, it has been (or
+	// will be) sent again by another worker, which records the outcome instead.
+	err = app.models.Webhooks.MarkDelivered(delivery, status)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		logger.PrintWarn("webhook delivery lease lost", nil)
+		return true
+	case err != nil:
+		logger.PrintError(err, nil)
+		return true
+	}
+
+	logger.PrintDebug("webhook delivered", map[string]any{"status": status})
+
+	return true
+}
+
+// POSTs the delivery to the webhook URL, returning the status code of the response
+// (or 0 if there wasn't one). Any response other than a 2xx is an error.
+//
+// The request body is a JSON object containing the delivery ID (which stays the same
+// when a delivery is retried, so receivers can ignore duplicates), the event and its
+// data. It is signed with the webhook secret: the Greenlight-Signature header has the
+// form "t=<unix time>,v1=<signature>", where the signature is the hex-encoded
+// HMAC-SHA256 of the time, a period and the body. Including the time lets receivers
+// reject old deliveries which are being replayed.
+func (app *application) sendWebhook(client *http.Client, delivery *data.Delivery) (int, error) {
+	body, err := json.Marshal(map[string]any{
+		"id":         delivery.ID,
+		"event":      delivery.Event,
+		"created_at": delivery.CreatedAt,
+		"data":       delivery.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(delivery.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Greenlight-Webhooks/"+version)
+	req.Header.Set("Greenlight-Event", delivery.Event)
+	req.Header.Set("Greenlight-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("Greenlight-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// Read (some of) the response body, so that the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// Handler for the "POST /v1/webhooks" endpoint. If no secret is given, one is
+// generated. The response is the only time the secret is sent back to the client.
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: input.Events,
+		Active: true,
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if webhook.Secret == "" {
+		webhook.Secret, err = data.GenerateWebhookSecret()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.modelsFor(r).Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "GET /v1/webhooks" endpoint.
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.modelsFor(r).Webhooks.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "GET /v1/webhooks/:id" endpoint.
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.modelsFor(r).Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "PATCH /v1/webhooks/:id" endpoint. It supports partial updates in
+// the same way as updateMovieHandler, and can be used to pause a webhook (by setting
+// active to false) or to rotate its secret.
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.modelsFor(r).Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	v.Check(input.Secret == nil || *input.Secret != "", "secret", "must not be empty")
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.modelsFor(r).Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Don't echo the secret back to the client.
+	webhook.Secret = ""
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "DELETE /v1/webhooks/:id" endpoint.
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.modelsFor(r).Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler for the "GET /v1/webhooks/:id/deliveries" endpoint, which shows the delivery
+// log for a webhook, newest first.
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.modelsFor(r).Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var filters data.Filters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// The deliveries are always sorted newest first.
+	filters.Sort = "-id"
+	filters.SortSafelist = []string{"-id"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.modelsFor(r).Webhooks.GetDeliveries(id, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
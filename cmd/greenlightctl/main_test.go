@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+)
+
+func TestNewFlagSet(t *testing.T) {
+	fs := newFlagSet("users create")
+
+	if fs.Name() != "users create" {
+		t.Errorf("got name %q; want %q", fs.Name(), "users create")
+	}
+	if fs.ErrorHandling() != flag.ExitOnError {
+		t.Errorf("got error handling %v; want %v", fs.ErrorHandling(), flag.ExitOnError)
+	}
+
+	email := fs.String("email", "", "")
+	activated := fs.Bool("activated", false, "")
+
+	err := fs.Parse([]string{"-email", "alice@example.com", "-activated", "movies:read", "movies:write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *email != "alice@example.com" {
+		t.Errorf("got email %q; want %q", *email, "alice@example.com")
+	}
+	if !*activated {
+		t.Errorf("got activated %t; want true", *activated)
+	}
+
+	want := []string{"movies:read", "movies:write"}
+	if !slices.Equal(fs.Args(), want) {
+		t.Errorf("got args %q; want %q", fs.Args(), want)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "", want: nil},
+		{in: "drama", want: []string{"drama"}},
+		{in: "drama, romance ,war", want: []string{"drama", "romance", "war"}},
+		{in: ",drama,, ,war,", want: []string{"drama", "war"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := splitList(tt.in); !slices.Equal(got, tt.want) {
+				t.Errorf("splitList(%q) = %q; want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	err := validationError(map[string]string{
+		"title": "must be provided",
+		"email": "must be a valid email address",
+	})
+
+	want := "invalid input:\n  email: must be a valid email address\n  title: must be provided"
+	if err.Error() != want {
+		t.Errorf("got %q; want %q", err.Error(), want)
+	}
+}
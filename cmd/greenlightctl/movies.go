@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// Writes the movies as a table, or a "movies" array in JSON (with the pagination
+// metadata, if given).
+func (c *cli) printMovies(metadata *data.Metadata, movies ...*data.Movie) error {
+	rows := make([][]string, 0, len(movies))
+
+	for _, movie := range movies {
+		rows = append(rows, []string{
+			strconv.FormatInt(movie.ID, 10),
+			movie.Title,
+			strconv.Itoa(int(movie.Year)),
+			fmt.Sprintf("%d mins", movie.Runtime),
+			strings.Join(movie.Genres, ","),
+			strconv.Itoa(int(movie.Version)),
+		})
+	}
+
+	env := envelope{"movies": movies}
+	if metadata != nil {
+		env["metadata"] = metadata
+	}
+
+	return c.print(env, []string{"ID", "TITLE", "YEAR", "RUNTIME", "GENRES", "VERSION"}, rows)
+}
+
+// Returns the movie with the ID, with a friendlier error if there is none.
+func (c *cli) movieByID(id int64) (*data.Movie, error) {
+	if id < 1 {
+		return nil, errUsage
+	}
+
+	movie, err := c.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, fmt.Errorf("no movie with ID %d", id)
+		default:
+			return nil, err
+		}
+	}
+
+	return movie, nil
+}
+
+// The "movies list" command, with the same filters, sorting and pagination as the
+// "GET /v1/movies" endpoint (though only the most useful of them).
+func (c *cli) listMovies(args []string) error {
+	fs := newFlagSet("movies list")
+	title := fs.String("title", "", "Only movies whose title matches")
+	genres := fs.String("genres", "", "Only movies with all of these comma-separated genres")
+	sort := fs.String("sort", "id", "Sort order (id, title, year, runtime, relevance; prefix with - for descending)")
+	page := fs.Int("page", 1, "Page number")
+	pageSize := fs.Int("page-size", 20, "Number of movies per page")
+	fs.Parse(args)
+
+	movieFilters := data.MovieFilters{
+		Title:  *title,
+		Genres: splitList(*genres),
+	}
+
+	filters := data.Filters{
+		Page:         *page,
+		PageSize:     *pageSize,
+		Sort:         *sort,
+		SortSafelist: []string{"id", "title", "year", "runtime", "relevance", "-id", "-title", "-year", "-runtime"},
+		IncludeTotal: true,
+	}
+
+	v := validator.New()
+
+	data.ValidateMovieFilters(v, movieFilters)
+	data.ValidateFilters(v, filters)
+
+	if filters.Sort == "relevance" {
+		v.Check(movieFilters.Title != "", "sort", "relevance sort requires a title filter")
+	}
+
+	if !v.Valid() {
+		return validationError(v.Errors)
+	}
+
+	movies, metadata, err := c.models.Movies.GetAll(movieFilters, filters)
+	if err != nil {
+		return err
+	}
+
+	return c.printMovies(&metadata, movies...)
+}
+
+// The "movies get" command.
+func (c *cli) getMovie(args []string) error {
+	fs := newFlagSet("movies get")
+	id := fs.Int64("id", 0, "ID of the movie")
+	fs.Parse(args)
+
+	movie, err := c.movieByID(*id)
+	if err != nil {
+		return err
+	}
+
+	return c.printMovies(nil, movie)
+}
+
+// The "movies create" command. As when a movie is created through the API, the
+// movie.created webhook event is sent.
+func (c *cli) createMovie(args []string) error {
+	fs := newFlagSet("movies create")
+	title := fs.String("title", "", "Title of the movie")
+	year := fs.Int("year", 0, "Year the movie was released")
+	runtime := fs.Int("runtime", 0, "Runtime in minutes")
+	genres := fs.String("genres", "", "Comma-separated genres")
+	fs.Parse(args)
+
+	movie := &data.Movie{
+		Title:   *title,
+		Year:    int32(*year),
+		Runtime: data.Runtime(*runtime),
+		Genres:  splitList(*genres),
+	}
+
+	v := validator.New()
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return validationError(v.Errors)
+	}
+
+	err := c.models.Movies.Insert(movie)
+	if err != nil {
+		return err
+	}
+
+	err = c.models.Webhooks.Enqueue(data.EventMovieCreated, movie)
+	if err != nil {
+		return err
+	}
+
+	return c.printMovies(nil, movie)
+}
+
+// The "movies delete" command. As when a movie is deleted through the API, the
+// movie.deleted webhook event is sent.
+func (c *cli) deleteMovie(args []string) error {
+	fs := newFlagSet("movies delete")
+	id := fs.Int64("id", 0, "ID of the movie")
+	fs.Parse(args)
+
+	movie, err := c.movieByID(*id)
+	if err != nil {
+		return err
+	}
+
+	err = c.models.Movies.Delete(movie.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return fmt.Errorf("no movie with ID %d", movie.ID)
+		default:
+			return err
+		}
+	}
+
+	err = c.models.Webhooks.Enqueue(data.EventMovieDeleted, map[string]int64{"id": movie.ID})
+	if err != nil {
+		return err
+	}
+
+	return c.printMessage("movie %d (%s) deleted", movie.ID, movie.Title)
+}
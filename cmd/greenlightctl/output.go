@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Define an envelope type, as in cmd/api, for the top-level JSON objects.
+type envelope map[string]any
+
+// Writes the result of a command to the output: the data as indented JSON if the
+// output format is "json", otherwise the table with the headers and rows. Either way,
+// the output of a command contains the same information.
+func (c *cli) print(data envelope, headers []string, rows [][]string) error {
+	if c.output == "json" {
+		js, err := json.MarshalIndent(data, "", "\t")
+		if err != nil {
+			return err
+		}
+
+		js = append(js, '\n')
+
+		_, err = c.out.Write(js)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// Writes a message about the outcome of a command which has no other output, as a
+// "message" object in JSON.
+func (c *cli) printMessage(format string, args ...any) error {
+	message := fmt.Sprintf(format, args...)
+
+	if c.output == "json" {
+		return c.print(envelope{"message": message}, nil, nil)
+	}
+
+	_, err := fmt.Fprintln(c.out, message)
+	return err
+}
+
+// Returns the keys of the map in order.
+func sortedKeys(m map[string]string) []string {
+	return slices.Sorted(maps.Keys(m))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"greenlight.mazavrbazavr.ru/internal/data"
+)
+
+func TestPrintMovies(t *testing.T) {
+	movies := []*data.Movie{
+		{ID: 1, Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}, Version: 1},
+		{ID: 12, Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}, Version: 3},
+	}
+
+	tests := []struct {
+		name     string
+		output   string
+		metadata *data.Metadata
+		want     string
+	}{
+		{
+			name:   "Table",
+			output: "table",
+			want: "ID  TITLE       YEAR  RUNTIME   GENRES         VERSION\n" +
+				"1   Casablanca  1942  102 mins  drama,romance  1\n" +
+				"12  Up          2009  96 mins   animation      3\n",
+		},
+		{
+			name:   "JSON",
+			output: "json",
+			want: `{
+	"movies": [
+		{
+			"id": 1,
+			"title": "Casablanca",
+			"year": 1942,
+			"runtime": "102 mins",
+			"genres": [
+				"drama",
+				"romance"
+			],
+			"version": 1
+		},
+		{
+			"id": 12,
+			"title": "Up",
+			"year": 2009,
+			"runtime": "96 mins",
+			"genres": [
+				"animation"
+			],
+			"version": 3
+		}
+	]
+}
+`,
+		},
+		{
+			name:     "JSON with metadata",
+			output:   "json",
+			metadata: &data.Metadata{CurrentPage: 1, PageSize: 1, FirstPage: 1, LastPage: 2, TotalRecords: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			c := &cli{output: tt.output, out: &buf}
+
+			err := c.printMovies(tt.metadata, movies...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.metadata != nil {
+				if !bytes.Contains(buf.Bytes(), []byte(`"metadata": {`)) {
+					t.Errorf("the output has no metadata:\n%s", buf.String())
+				}
+				return
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintMessage(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{output: "table", want: "granted 2 permissions to alice@example.com\n"},
+		{output: "json", want: "{\n\t\"message\": \"granted 2 permissions to alice@example.com\"\n}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			c := &cli{output: tt.output, out: &buf}
+
+			err := c.printMessage("granted %d permissions to %s", 2, "alice@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
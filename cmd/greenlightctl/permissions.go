@@ -0,0 +1,132 @@
+package main
+
+import (
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// Writes the permission codes as a table, or a "permissions" array in JSON.
+func (c *cli) printPermissions(permissions data.Permissions) error {
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	rows := make([][]string, 0, len(permissions))
+	for _, code := range permissions {
+		rows = append(rows, []string{code})
+	}
+
+	return c.print(envelope{"permissions": permissions}, []string{"PERMISSION"}, rows)
+}
+
+// Checks that the permission codes exist. Granting a permission which doesn't exist
+// would silently do nothing, so a typo is better reported.
+func (c *cli) validatePermissions(v *validator.Validator, codes []string) {
+	all, err := c.models.Permissions.GetAll()
+	if err != nil {
+		v.AddError("permissions", err.Error())
+		return
+	}
+
+	for _, code := range codes {
+		v.Check(all.Include(code), "permissions", "unknown permission "+code)
+	}
+}
+
+// The "permissions list" command, which lists all the permission codes.
+func (c *cli) listPermissions(args []string) error {
+	fs := newFlagSet("permissions list")
+	fs.Parse(args)
+
+	permissions, err := c.models.Permissions.GetAll()
+	if err != nil {
+		return err
+	}
+
+	return c.printPermissions(permissions)
+}
+
+// The "permissions show" command, which lists the permissions of a user.
+func (c *cli) showPermissions(args []string) error {
+	fs := newFlagSet("permissions show")
+	email := fs.String("email", "", "Email address of the user")
+	fs.Parse(args)
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	permissions, err := c.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.printPermissions(permissions)
+}
+
+// The "permissions grant" command. Granting a permission the user already has isn't an
+// error. The user's permissions are shown afterwards.
+func (c *cli) grantPermissions(args []string) error {
+	fs := newFlagSet("permissions grant")
+	email := fs.String("email", "", "Email address of the user")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	v := validator.New()
+
+	c.validatePermissions(v, fs.Args())
+
+	if !v.Valid() {
+		return validationError(v.Errors)
+	}
+
+	err = c.models.Permissions.AddForUser(user.ID, fs.Args()...)
+	if err != nil {
+		return err
+	}
+
+	permissions, err := c.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.printPermissions(permissions)
+}
+
+// The "permissions revoke" command. Revoking a permission the user doesn't have isn't
+// an error. The user's permissions are shown afterwards.
+func (c *cli) revokePermissions(args []string) error {
+	fs := newFlagSet("permissions revoke")
+	email := fs.String("email", "", "Email address of the user")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	err = c.models.Permissions.RemoveForUser(user.ID, fs.Args()...)
+	if err != nil {
+		return err
+	}
+
+	permissions, err := c.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.printPermissions(permissions)
+}
@@ -0,0 +1,35 @@
+package main
+
+// The "tokens purge" command, which deletes the expired tokens. They are never accepted,
+// so this can be run at any time (e.g. from cron) to keep the tokens table small.
+func (c *cli) purgeTokens(args []string) error {
+	fs := newFlagSet("tokens purge")
+	fs.Parse(args)
+
+	n, err := c.models.Tokens.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	return c.printMessage("%d expired token(s) deleted", n)
+}
+
+// The "tokens revoke" command, which deletes all the tokens of a user, signing them out
+// everywhere (and invalidating any activation tokens they haven't used yet).
+func (c *cli) revokeTokens(args []string) error {
+	fs := newFlagSet("tokens revoke")
+	email := fs.String("email", "", "Email address of the user")
+	fs.Parse(args)
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	n, err := c.models.Tokens.DeleteAllScopesForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.printMessage("%d token(s) deleted for user %q", n, user.Email)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+	"greenlight.mazavrbazavr.ru/internal/data"
+	"greenlight.mazavrbazavr.ru/internal/mailer"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// Writes the users as a table, or a "users" array in JSON.
+func (c *cli) printUsers(users ...*data.User) error {
+	rows := make([][]string, 0, len(users))
+
+	for _, user := range users {
+		rows = append(rows, []string{
+			strconv.FormatInt(user.ID, 10),
+			user.Email,
+			user.Name,
+			strconv.FormatBool(user.Activated),
+			user.Locale,
+			user.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	headers := []string{"ID", "EMAIL", "NAME", "ACTIVATED", "LOCALE", "CREATED AT"}
+
+	return c.print(envelope{"users": users}, headers, rows)
+}
+
+// Returns the user with the email address, with a friendlier error if there is none.
+func (c *cli) userByEmail(email string) (*data.User, error) {
+	if email == "" {
+		return nil, errUsage
+	}
+
+	user, err := c.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, fmt.Errorf("no user with email %q", email)
+		default:
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// Returns the password from the flag or, if it wasn't given, reads it from standard
+// input (so that it doesn't end up in the shell history). At a terminal the password
+// is prompted for without being echoed; otherwise (e.g. when it is piped in) the first
+// line is read.
+func readPassword(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "password: ")
+
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+
+		return string(password), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// The "users list" command.
+func (c *cli) listUsers(args []string) error {
+	fs := newFlagSet("users list")
+	fs.Parse(args)
+
+	users, err := c.models.Users.GetAll()
+	if err != nil {
+		return err
+	}
+
+	return c.printUsers(users...)
+}
+
+// The "users get" command.
+func (c *cli) getUser(args []string) error {
+	fs := newFlagSet("users get")
+	email := fs.String("email", "", "Email address of the user")
+	fs.Parse(args)
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	return c.printUsers(user)
+}
+
+// The "users create" command. Unlike registering through the API, this doesn't send a
+// welcome email, so it can create the first administrator (with -activated and
+// -permissions=movies:read,movies:write,admin:read,admin:write) before the mailer is
+// set up.
+func (c *cli) createUser(args []string) error {
+	fs := newFlagSet("users create")
+	name := fs.String("name", "", "Name of the user")
+	email := fs.String("email", "", "Email address of the user")
+	passwordFlag := fs.String("password", "", "Password (read from standard input if not given)")
+	activated := fs.Bool("activated", false, "Create the user already activated")
+	locale := fs.String("locale", mailer.DefaultLocale, "Locale of the user")
+	permissions := fs.String("permissions", "movies:read", "Comma-separated permission codes to grant")
+	fs.Parse(args)
+
+	password, err := readPassword(*passwordFlag)
+	if err != nil {
+		return err
+	}
+
+	user := &data.User{
+		Name:      *name,
+		Email:     *email,
+		Activated: *activated,
+		Locale:    *locale,
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+
+	v := validator.New()
+
+	data.ValidateUser(v, user)
+	c.validatePermissions(v, splitList(*permissions))
+
+	if !v.Valid() {
+		return validationError(v.Errors)
+	}
+
+	err = c.models.Users.Create(user, splitList(*permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			return fmt.Errorf("a user with email %q already exists", user.Email)
+		default:
+			return err
+		}
+	}
+
+	return c.printUsers(user)
+}
+
+// The "users activate" command. As when a user activates their account through the
+// API, the activation tokens are deleted and the user.activated webhook event is sent.
+func (c *cli) activateUser(args []string) error {
+	fs := newFlagSet("users activate")
+	email := fs.String("email", "", "Email address of the user")
+	fs.Parse(args)
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	if user.Activated {
+		return c.printMessage("user %q is already activated", user.Email)
+	}
+
+	user.Activated = true
+
+	err = c.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return errors.New("the user was changed at the same time, please try again")
+		default:
+			return err
+		}
+	}
+
+	err = c.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = c.models.Webhooks.Enqueue(data.EventUserActivated, user)
+	if err != nil {
+		return err
+	}
+
+	return c.printUsers(user)
+}
+
+// The "users set-password" command. All the user's tokens are deleted, so that anyone
+// signed in with the old password is signed out.
+func (c *cli) setUserPassword(args []string) error {
+	fs := newFlagSet("users set-password")
+	email := fs.String("email", "", "Email address of the user")
+	passwordFlag := fs.String("password", "", "New password (read from standard input if not given)")
+	fs.Parse(args)
+
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword(*passwordFlag)
+	if err != nil {
+		return err
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, password)
+
+	if !v.Valid() {
+		return validationError(v.Errors)
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+
+	err = c.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return errors.New("the user was changed at the same time, please try again")
+		default:
+			return err
+		}
+	}
+
+	_, err = c.models.Tokens.DeleteAllScopesForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.printMessage("password changed for user %q", user.Email)
+}
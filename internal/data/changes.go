@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// MovieChange struct to hold an entry in the movie_changes log, which a database
+// trigger adds to whenever a movie is created, updated or deleted. The Position is the
+// place of the change in the order the changes are streamed in (see SequenceChanges()).
+// The Event is one of the webhook event names (e.g. "movie.updated"), and Movie holds
+// the movie as it was after the change, or nil for a deletion.
+type MovieChange struct {
+	ID        int64     `json:"-"`
+	Position  int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"-"`
+	MovieID   int64     `json:"movie_id"`
+	Movie     *Movie    `json:"movie,omitempty"`
+}
+
+// The key of the PostgreSQL advisory lock which is held while assigning positions to
+// the changes, so that only one transaction at a time does it.
+const sequenceChangesLockKey int64 = 7_265_616_378_119_524_402
+
+// Assigns the next positions in the log to the changes which don't have one yet, in the
+// order of their IDs, and returns how many there were.
+//
+// The changes are streamed in the order of their positions rather than their IDs. An
+// ID is assigned when the change is made, but the change can only be read once its
+// transaction has committed, so a long transaction (like an atomic import) can commit
+// a change with a lower ID after a change with a higher ID has been streamed, which
+// clients resuming from the higher ID would never get. A position is only assigned
+// once the change has been committed, and the advisory lock (held until the end of the
+// transaction) makes the transactions assigning them take turns, so no position is
+// ever committed after a higher one.
+func (m MovieModel) SequenceChanges() (int64, error) {
+	query := `
+        WITH unsequenced AS (
+            SELECT id, row_number() OVER (ORDER BY id) AS n
+            FROM movie_changes
+            WHERE position IS NULL
+        )
+        UPDATE movie_changes
+        SET position = (SELECT COALESCE(MAX(position), 0) FROM movie_changes) + unsequenced.n
+        FROM unsequenced
+        WHERE movie_changes.id = unsequenced.id`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The UPDATE runs with a snapshot taken after the lock has been acquired, so it sees
+	// the positions assigned by the transaction which held it before.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, sequenceChangesLockKey)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	sequenced, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return sequenced, nil
+}
+
+// Returns the position of the latest change in the log, or 0 if there are none.
+func (m MovieModel) LatestChangePosition() (int64, error) {
+	query := `
+        SELECT COALESCE(MAX(position), 0)
+        FROM movie_changes`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	var position int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&position)
+	return position, err
+}
+
+// Returns up to limit changes from the log which came after the given position, in
+// order. Changes which haven't been given a position yet are left out.
+func (m MovieModel) ChangesSince(afterPosition int64, limit int) ([]*MovieChange, error) {
+	query := `
+        SELECT id, position, created_at, event, movie_id, movie
+        FROM movie_changes
+        WHERE position > $1
+        ORDER BY position
+        LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, afterPosition, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*MovieChange{}
+
+	for rows.Next() {
+		var change MovieChange
+		var movie []byte
+
+		err := rows.Scan(&change.ID, &change.Position, &change.CreatedAt, &change.Event, &change.MovieID, &movie)
+		if err != nil {
+			return nil, err
+		}
+
+		// The trigger stores the row using to_jsonb(), so the runtime is a plain number
+		// rather than the "<runtime> mins" string which the Runtime type expects.
+		if movie != nil {
+			var row struct {
+				ID      int64    `json:"id"`
+				Title   string   `json:"title"`
+				Year    int32    `json:"year"`
+				Runtime int32    `json:"runtime"`
+				Genres  []string `json:"genres"`
+				Version int32    `json:"version"`
+			}
+
+			err = json.Unmarshal(movie, &row)
+			if err != nil {
+				return nil, err
+			}
+
+			change.Movie = &Movie{
+				ID:      row.ID,
+				Title:   row.Title,
+				Year:    row.Year,
+				Runtime: Runtime(row.Runtime),
+				Genres:  row.Genres,
+				Version: row.Version,
+			}
+		}
+
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Deletes the changes older than the given time from the log.
+func (m MovieModel) DeleteChangesBefore(t time.Time) error {
+	query := `
+        DELETE FROM movie_changes
+        WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 30*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, t)
+	return err
+}
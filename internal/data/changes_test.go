@@ -0,0 +1,134 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/lib/pq"
+	"greenlight.mazavrbazavr.ru/internal/migrate"
+	"greenlight.mazavrbazavr.ru/migrations"
+)
+
+// Opens the test database named by the GREENLIGHT_TEST_DB_DSN environment variable and
+// migrates it, or skips the test if the variable isn't set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN isn't set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = migrator.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// A change committed after a change with a higher ID has been streamed must still be
+// streamed to the clients which resume from the later change.
+func TestChangesSinceInterleavedTransactions(t *testing.T) {
+	db := openTestDB(t)
+	movies := MovieModel{DB: db}
+	ctx := context.Background()
+
+	insert := `
+        INSERT INTO movies (title, year, runtime, genres)
+        VALUES ($1, 2024, 90, $2)
+        RETURNING id`
+
+	var movieIDs []int64
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM movies WHERE id = ANY($1)`, pq.Array(movieIDs))
+	})
+
+	_, err := movies.SequenceChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := movies.LatestChangePosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first transaction creates movie A, so its change gets the lower ID, but stays
+	// open while movie B is created and committed.
+	txA, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txA.Rollback()
+
+	var movieA, movieB int64
+
+	err = txA.QueryRowContext(ctx, insert, "Interleaved A", pq.Array([]string{"drama"})).Scan(&movieA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movieIDs = append(movieIDs, movieA)
+
+	err = db.QueryRowContext(ctx, insert, "Interleaved B", pq.Array([]string{"drama"})).Scan(&movieB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movieIDs = append(movieIDs, movieB)
+
+	// Only movie B's change can be streamed so far.
+	_, err = movies.SequenceChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := movies.ChangesSince(start, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].MovieID != movieB {
+		t.Fatalf("got %d changes before movie A was committed; want only the one for movie B", len(changes))
+	}
+	changeB := changes[0]
+
+	err = txA.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client which has received movie B's change still gets movie A's, even though it
+	// has a lower ID.
+	_, err = movies.SequenceChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = movies.ChangesSince(changeB.Position, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].MovieID != movieA {
+		t.Fatalf("got %d changes after movie B's; want only the one for movie A", len(changes))
+	}
+	changeA := changes[0]
+
+	if changeA.ID >= changeB.ID {
+		t.Errorf("got change IDs %d (A) and %d (B); want A's to be lower", changeA.ID, changeB.ID)
+	}
+	if changeA.Position <= changeB.Position {
+		t.Errorf("got positions %d (A) and %d (B); want A's to be higher", changeA.Position, changeB.Position)
+	}
+}
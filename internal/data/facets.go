@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// The SQL expressions used to derive the value of each supported facet from a row in
+// the movies table. The keys of this map double as the safelist of facet names which
+// the client is allowed to request, so only these hard-coded fragments ever make it
+// into the facets query.
+var facetExpressions = map[string]string{
+	"genres": "unnest(genres)",
+	"year":   "year::text",
+	"decade": "((year / 10) * 10)::text || 's'",
+	"runtime_bucket": `CASE
+            WHEN runtime < 90 THEN '0-89'
+            WHEN runtime < 120 THEN '90-119'
+            WHEN runtime < 150 THEN '120-149'
+            ELSE '150+'
+        END`,
+}
+
+// FacetsSafelist holds the names of the facets which can be requested by the client,
+// in the order in which they are queried.
+var FacetsSafelist = []string{"genres", "year", "decade", "runtime_bucket"}
+
+// FacetCount holds the number of movies which share a specific facet value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets maps the facet name (e.g. "genres") to the counts for each of its values.
+type Facets map[string][]FacetCount
+
+// Checks that every requested facet name is in the safelist and that there are no
+// duplicates.
+func ValidateFacets(v *validator.Validator, facets []string) {
+	for _, facet := range facets {
+		v.Check(validator.PermittedValue(facet, FacetsSafelist...), "facets", "invalid facet value")
+	}
+
+	v.Check(validator.Unique(facets), "facets", "must not contain duplicate values")
+}
+
+// The GetFacets() method accepts the same movie filters as GetAll() and
+// returns the number of matching movies for each value of the requested facets. All
+// the facets are calculated in a single round-trip to the database: the filtered
+// movies are selected once in a CTE, and then one aggregate per facet is combined
+// with UNION ALL.
+func (m MovieModel) GetFacets(movieFilters MovieFilters, facets []string) (Facets, error) {
+	result := Facets{}
+
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	// Build the WHERE clause for the filtered movies first, collecting the values for
+	// its placeholders in the args slice.
+	args := []any{}
+	where := movieFilters.where(&args)
+
+	// Then build one SELECT ... GROUP BY statement for each requested facet. The facet
+	// name is passed as a placeholder parameter and the value expression is taken from
+	// the facetExpressions map, so no client-provided data is interpolated into the SQL.
+	selects := make([]string, 0, len(facets))
+
+	for _, facet := range facets {
+		expression, ok := facetExpressions[facet]
+		if !ok {
+			// As with the sort parameter, this should have already been caught by
+			// ValidateFacets(), but it's a sensible failsafe.
+			panic("unsafe facet parameter: " + facet)
+		}
+
+		selects = append(selects, fmt.Sprintf(`
+            SELECT %s::text AS facet, value, count(*) AS count
+            FROM (SELECT %s AS value FROM filtered) AS f
+            GROUP BY value`, addArg(&args, facet), expression))
+	}
+
+	query := `
+        WITH filtered AS (
+            SELECT year, runtime, genres
+            FROM movies
+            WHERE ` + where + `
+        )` + strings.Join(selects, `
+        UNION ALL`) + `
+        ORDER BY facet, count DESC, value ASC`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Make sure that every requested facet is present in the result, even if there
+	// are no matching movies for it.
+	for _, facet := range facets {
+		result[facet] = []FacetCount{}
+	}
+
+	for rows.Next() {
+		var facet string
+		var count FacetCount
+
+		err := rows.Scan(&facet, &count.Value, &count.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		result[facet] = append(result[facet], count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -1,6 +1,11 @@
 package data
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"strings"
 
@@ -14,6 +19,8 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string // holds the supported sort values
+	Cursor       string   // opaque keyset pagination cursor, takes over from Page if set
+	IncludeTotal bool     // whether to count the total number of matching records
 }
 
 // Checks that the client-provided Sort field matches one of the entries in our safelist
@@ -41,16 +48,133 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// Returns the opposite of the given sort direction.
+func reverseDirection(direction string) string {
+	if direction == "ASC" {
+		return "DESC"
+	}
+
+	return "ASC"
+}
+
 // Get the DB LIMIT value.
 func (f Filters) limit() int {
 	return f.PageSize
 }
 
-// Get the DB OFFSET value.
+// Get the DB OFFSET value. When paginating with a cursor the position is given by the
+// cursor itself, so there is nothing to skip.
 func (f Filters) offset() int {
+	if f.Cursor != "" {
+		return 0
+	}
+
 	return (f.Page - 1) * f.PageSize
 }
 
+// Define an error which is returned when a cursor can't be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A cursor marks a position in a sorted list of records for keyset pagination: the
+// value of the sort column and the ID of the record at the edge of a page. It also
+// records the sort that it was created for, and whether it points to the page before
+// (Prev) or after that record. It is handed to clients as an opaque string.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value any    `json:"v"`
+	ID    int64  `json:"id"`
+	Prev  bool   `json:"p,omitempty"`
+}
+
+// Encodes the cursor as a URL-safe base64 string of its JSON representation.
+func (c cursor) encode() string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		// The cursor only ever contains strings and numbers, so this can't happen.
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// Decodes a cursor string created by encode(). JSON numbers are converted back to
+// int64 values, as all of the numeric sort columns are integers.
+func decodeCursor(s string) (cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	err = dec.Decode(&c)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	switch value := c.Value.(type) {
+	case json.Number:
+		i, err := value.Int64()
+		if err != nil {
+			return cursor{}, ErrInvalidCursor
+		}
+		c.Value = i
+	case string:
+	default:
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// The sort columns which hold text. All the other sort columns which cursors are
+// created for hold integers.
+var textSortColumns = []string{"title"}
+
+// Reports whether the cursor's value has the right type for the sort column: a string
+// for the text columns, an int64 for the others. A cursor which has been tampered with
+// could otherwise have its value compared against a column of another type, which
+// PostgreSQL rejects with an error.
+func (c cursor) valueMatches(column string) bool {
+	switch c.Value.(type) {
+	case string:
+		return slices.Contains(textSortColumns, column)
+	case int64:
+		return !slices.Contains(textSortColumns, column)
+	default:
+		return false
+	}
+}
+
+// Builds the keyset pagination condition for the cursor, which selects the records
+// coming after (or, for a Prev cursor, before) the record that the cursor points to in
+// the current sort order. Remember that the secondary sort on the ID is always
+// ascending, whatever the direction of the primary sort. The cursor values are passed
+// as placeholder parameters.
+func (c cursor) condition(column, direction string, args *[]any) string {
+	// Work out which way we need to go through the sorted list.
+	after := direction == "ASC"
+	if c.Prev {
+		after = !after
+	}
+
+	valueOp, idOp := ">", ">"
+	if !after {
+		valueOp = "<"
+	}
+	if c.Prev {
+		idOp = "<"
+	}
+
+	value, id := addArg(args, c.Value), addArg(args, c.ID)
+
+	return fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND id %[4]s %[5]s))",
+		column, valueOp, value, idOp, id)
+}
+
 // Checks that the Filters struct contains valid values.
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
@@ -61,15 +185,29 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	// If a cursor is provided, check that it is one which we have created, with a value
+	// of the right type for the sort column, and that it was created for the same sort
+	// order. The page parameter makes no sense together with a cursor.
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil, "cursor", "invalid cursor value")
+		v.Check(err != nil || c.valueMatches(strings.TrimPrefix(c.Sort, "-")), "cursor", "invalid cursor value")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "must be used with the same sort value it was created for")
+		v.Check(f.Page == 1, "page", "must not be used together with cursor")
+	}
 }
 
-// Metadata struct for holding the pagination metadata.
+// Metadata struct for holding the pagination metadata. The cursors can be passed back
+// in the cursor parameter to fetch the next or previous page using keyset pagination.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // Calculates the appropriate pagination metadata values given the total number
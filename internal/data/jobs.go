@@ -0,0 +1,327 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Constants for the job status. A job starts off as queued, becomes running when
+// a worker picks it up, and ends up either succeeded or failed. A job which fails but
+// has attempts left goes back to queued, to be retried later.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job struct to hold the data for an individual background job. The Kind field selects
+// the code which runs the job, and the Payload holds its input as raw JSON. Progress is
+// a percentage, and Result holds the output of a successful job, again as raw JSON.
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	UserID      int64           `json:"-"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"-"`
+	Status      string          `json:"status"`
+	Progress    int             `json:"progress"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"-"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// Define the JobModel type.
+type JobModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// Adds a new job to the queue, to be run as soon as a worker is available. The payload
+// is encoded to JSON. The system-generated data is read back into the Job struct.
+func (m JobModel) Insert(job *Job, payload any) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO jobs (user_id, kind, payload, max_attempts)
+        VALUES (NULLIF($1, 0), $2, $3, $4)
+        RETURNING id, created_at, updated_at, status, run_at`
+
+	// Note that we pass the JSON as a string: lib/pq sends []byte values in the binary
+	// format, which PostgreSQL doesn't accept for jsonb columns.
+	args := []any{job.UserID, job.Kind, string(js), job.MaxAttempts}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).
+		Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt, &job.Status, &job.RunAt)
+	if err != nil {
+		return err
+	}
+
+	job.Payload = js
+	return nil
+}
+
+// Retrieves a specific job.
+func (m JobModel) Get(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, updated_at, COALESCE(user_id, 0), kind, payload, status,
+            progress, attempts, max_attempts, run_at, result, COALESCE(last_error, '')
+        FROM jobs
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return job, nil
+}
+
+// Returns how long the oldest job which is due to run has been waiting, or 0 if there
+// are none. This is the lag of the job queue: if it keeps growing, the workers can't
+// keep up. Running jobs whose lease has expired count as waiting, since they will be
+// claimed again.
+func (m JobModel) QueueLag() (time.Duration, error) {
+	query := `
+        SELECT COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(run_at)), 0)
+        FROM jobs
+        WHERE status IN ('queued', 'running') AND run_at <= NOW()`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	var seconds float64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Claims the next job which is due to run, marking it as running and counting the
+// attempt. If there is no such job, it returns ErrRecordNotFound.
+//
+// The SELECT ... FOR UPDATE SKIP LOCKED makes it safe for any number of workers (in
+// any number of processes) to claim jobs at the same time: each of them locks the job
+// that it finds, and skips over any job already locked by another worker, so the same
+// job is never handed out twice.
+//
+// A claimed job gets a lease: its run_at is pushed lease into the future. If the
+// process running the job crashes, the job stays in the running status and is claimed
+// again once its lease has expired, so it isn't lost. While the job runs, the worker
+// keeps extending the lease with ExtendLease().
+//
+// A job whose lease expired on its last attempt has no attempts left, so it isn't
+// claimed again. Instead, the same statement marks it as failed for good.
+func (m JobModel) Claim(lease time.Duration) (*Job, error) {
+	query := `
+        WITH abandoned AS (
+            UPDATE jobs
+            SET status = 'failed', last_error = 'lease expired on the last attempt', updated_at = NOW()
+            WHERE id IN (
+                SELECT id
+                FROM jobs
+                WHERE status = 'running' AND run_at <= NOW() AND attempts >= max_attempts
+                FOR UPDATE SKIP LOCKED
+            )
+        )
+        UPDATE jobs
+        SET status = 'running', attempts = attempts + 1, run_at = NOW() + make_interval(secs => $1),
+            updated_at = NOW()
+        WHERE id = (
+            SELECT id
+            FROM jobs
+            WHERE status IN ('queued', 'running') AND run_at <= NOW() AND attempts < max_attempts
+            ORDER BY run_at, id
+            FOR UPDATE SKIP LOCKED
+            LIMIT 1
+        )
+        RETURNING id, created_at, updated_at, COALESCE(user_id, 0), kind, payload, status,
+            progress, attempts, max_attempts, run_at, result, COALESCE(last_error, '')`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, lease.Seconds()))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return job, nil
+}
+
+// Extends the lease on a running job. If the job is no longer held by this attempt
+// (because its lease expired and it was claimed again, or marked as failed) it returns
+// ErrRecordNotFound, and the worker should give up on the job.
+func (m JobModel) ExtendLease(job *Job, lease time.Duration) error {
+	query := `
+        UPDATE jobs
+        SET run_at = NOW() + make_interval(secs => $1), updated_at = NOW()
+        WHERE id = $2 AND status = 'running' AND attempts = $3`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	return execOnClaimed(ctx, m.DB, query, lease.Seconds(), job.ID, job.Attempts)
+}
+
+// Records the progress (as a percentage) of a running job, and extends its lease. Like
+// ExtendLease(), it returns ErrRecordNotFound if the job is no longer held by this
+// attempt.
+func (m JobModel) UpdateProgress(job *Job, progress int, lease time.Duration) error {
+	query := `
+        UPDATE jobs
+        SET progress = $1, run_at = NOW() + make_interval(secs => $2), updated_at = NOW()
+        WHERE id = $3 AND status = 'running' AND attempts = $4`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := execOnClaimed(ctx, m.DB, query, progress, lease.Seconds(), job.ID, job.Attempts)
+	if err != nil {
+		return err
+	}
+
+	job.Progress = progress
+	return nil
+}
+
+// Executes an UPDATE of a claimed row (a running job, or a webhook delivery being sent),
+// returning ErrRecordNotFound if it didn't match the row, because the claim was lost.
+func execOnClaimed(ctx context.Context, db *sql.DB, query string, args ...any) error {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Marks a job as succeeded, storing its result encoded as JSON. Like ExtendLease(), it
+// returns ErrRecordNotFound if the job is no longer held by this attempt, so that a
+// worker which has lost its lease can't overwrite the outcome of the next attempt.
+func (m JobModel) Succeed(job *Job, result any) error {
+	js, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        UPDATE jobs
+        SET status = 'succeeded', progress = 100, result = $1, last_error = NULL, updated_at = NOW()
+        WHERE id = $2 AND status = 'running' AND attempts = $3`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err = execOnClaimed(ctx, m.DB, query, string(js), job.ID, job.Attempts)
+	if err != nil {
+		return err
+	}
+
+	job.Status, job.Progress, job.Result = JobSucceeded, 100, js
+	return nil
+}
+
+// Records a failed attempt to run a job. If the job has attempts left, it goes back in
+// the queue to be retried after the given delay; otherwise it is marked as failed for
+// good. Again, it returns ErrRecordNotFound if the job is no longer held by this
+// attempt.
+func (m JobModel) Fail(job *Job, jobErr error, retryAfter time.Duration) error {
+	status := JobQueued
+	if job.Attempts >= job.MaxAttempts {
+		status = JobFailed
+	}
+
+	query := `
+        UPDATE jobs
+        SET status = $1, last_error = $2, run_at = NOW() + make_interval(secs => $3), updated_at = NOW()
+        WHERE id = $4 AND status = 'running' AND attempts = $5`
+
+	args := []any{status, jobErr.Error(), retryAfter.Seconds(), job.ID, job.Attempts}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := execOnClaimed(ctx, m.DB, query, args...)
+	if err != nil {
+		return err
+	}
+
+	job.Status, job.LastError = status, jobErr.Error()
+	return nil
+}
+
+// Scans a row containing all the job columns (in the order used by the queries above)
+// into a new Job struct.
+func scanJob(row *sql.Row) (*Job, error) {
+	// The jsonb columns are scanned into plain byte slices, so that database/sql gives
+	// us our own copy of the data rather than a reference to the driver's buffer.
+	var job Job
+	var payload, result []byte
+
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.UserID,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Progress,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&result,
+		&job.LastError,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// A NULL result is scanned as a nil slice, which means that the result will be
+	// omitted from the JSON.
+	job.Payload, job.Result = payload, result
+
+	return &job, nil
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
@@ -12,19 +13,53 @@ var (
 )
 
 type Models struct {
+	Jobs        JobModel
 	Movies      MovieModel
+	Outbox      EmailOutboxModel
 	Permissions PermissionModel
+	Schema      SchemaModel
 	Tokens      TokenModel
 	Users       UserModel
+	Webhooks    WebhookModel
 }
 
 // A New() method which returns a Models struct containing the initialized MovieModel
 // (for ease of use).
 func NewModels(db *sql.DB) Models {
 	return Models{
+		Jobs:        JobModel{DB: db},
 		Movies:      MovieModel{DB: db},
+		Outbox:      EmailOutboxModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Schema:      SchemaModel{DB: db},
 		Tokens:      TokenModel{DB: db},
 		Users:       UserModel{DB: db},
+		Webhooks:    WebhookModel{DB: db},
 	}
 }
+
+// Returns a copy of the models which use the given context as the parent of the
+// contexts for their queries. Handlers use this with the request context, so that the
+// queries carry the request's trace span and show up as its children in the trace.
+func (m Models) WithContext(ctx context.Context) Models {
+	m.Jobs.ctx = ctx
+	m.Movies.ctx = ctx
+	m.Outbox.ctx = ctx
+	m.Permissions.ctx = ctx
+	m.Schema.ctx = ctx
+	m.Tokens.ctx = ctx
+	m.Users.ctx = ctx
+	m.Webhooks.ctx = ctx
+	return m
+}
+
+// Returns the parent for the context of a query. Only the values of the bound context
+// are used: it isn't cancelled along with the bound context, so that (as before the
+// models were bound to the request context) a query isn't abandoned halfway because
+// the client has gone away.
+func parentContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return context.WithoutCancel(ctx)
+}
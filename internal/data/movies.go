@@ -15,11 +15,15 @@ gives us more flexibility.
 package data
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/lib/pq"
 	"greenlight.mazavrbazavr.ru/internal/validator"
@@ -66,7 +70,8 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 // A MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
-	DB *sql.DB
+	DB  *sql.DB
+	ctx context.Context
 }
 
 // The Insert() method accepts a pointer to a movie struct, which should contain the
@@ -85,7 +90,7 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// make it nice and clear *what values are being used where* in the query.
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	// Use the QueryRowContext() method to execute the SQL query on our connection pool,
@@ -96,6 +101,104 @@ func (m MovieModel) Insert(movie *Movie) error {
 		Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
+// The number of movies inserted by each statement in InsertAll(). Every movie takes 4
+// placeholder parameters, and PostgreSQL allows at most 65535 of them in a statement.
+const insertAllBatchSize = 1000
+
+// The InsertAll() method inserts a batch of movies in a single transaction, so either
+// all of them are created or none are. Like Insert(), it updates each movie struct
+// with the system-generated data for its new record.
+//
+// Rather than a round trip to the database for every movie, the movies are inserted
+// with multi-row INSERT statements of up to insertAllBatchSize movies each. (COPY would
+// be faster still, but it can't return the generated IDs.)
+func (m MovieModel) InsertAll(movies []*Movie) error {
+	// A batch can contain thousands of movies, so we allow more time than usual.
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 20*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Roll back the transaction if we return early with an error. Once the transaction
+	// has been committed this is a no-op.
+	defer tx.Rollback()
+
+	for batch := range slices.Chunk(movies, insertAllBatchSize) {
+		err = insertMovieBatch(ctx, tx, batch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Inserts the movies with a single multi-row INSERT statement, and updates each movie
+// struct with the system-generated data for its new record.
+func insertMovieBatch(ctx context.Context, tx *sql.Tx, movies []*Movie) error {
+	values := make([]string, len(movies))
+	args := make([]any, 0, 4*len(movies))
+
+	for i, movie := range movies {
+		values[i] = fmt.Sprintf("(%s, %s, %s, %s)",
+			addArg(&args, movie.Title), addArg(&args, movie.Year),
+			addArg(&args, movie.Runtime), addArg(&args, pq.Array(movie.Genres)))
+	}
+
+	query := `
+        INSERT INTO movies (title, year, runtime, genres)
+        VALUES ` + strings.Join(values, ", ") + `
+        RETURNING id, created_at, version`
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type inserted struct {
+		id        int64
+		createdAt time.Time
+		version   int32
+	}
+
+	results := make([]inserted, 0, len(movies))
+
+	for rows.Next() {
+		var r inserted
+
+		err := rows.Scan(&r.id, &r.createdAt, &r.version)
+		if err != nil {
+			return err
+		}
+
+		results = append(results, r)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(results) != len(movies) {
+		return fmt.Errorf("inserted %d movies but got %d rows back", len(movies), len(results))
+	}
+
+	// PostgreSQL doesn't promise to return the rows in the order of the VALUES list.
+	// But the rows are inserted in that order, so the IDs taken from the sequence
+	// increase along the list, and sorting by ID matches each row with its movie.
+	slices.SortFunc(results, func(a, b inserted) int {
+		return cmp.Compare(a.id, b.id)
+	})
+
+	for i, movie := range movies {
+		movie.ID, movie.CreatedAt, movie.Version = results[i].id, results[i].createdAt, results[i].version
+	}
+
+	return nil
+}
+
 // The Get() method accepts an id parameter, fetches the record from the database
 // and returns a pointer to a Movie struct.
 func (m MovieModel) Get(id int64) (*Movie, error) {
@@ -117,9 +220,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	var movie Movie
 
 	// Use the context.WithTimeout() function to create a context.Context which carries a
-	// 3-second timeout deadline. Note that we're using the empty context.Background()
-	// as the 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// 3-second timeout deadline. The 'parent' context is the one the models were bound
+	// to with Models.WithContext() (see parentContext()), or context.Background().
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
@@ -178,7 +281,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	}
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	// Use the QueryRowContext() method to execute the query, passing in context
@@ -213,7 +316,7 @@ func (m MovieModel) Delete(id int64) error {
         WHERE id = $1`
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	// Execute the SQL query using the ExecContext() method, passing in the context
@@ -241,33 +344,223 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
+// MovieFilters holds the optional conditions which narrow down the list of movies. The
+// zero value of every field means "don't filter on this".
+type MovieFilters struct {
+	Title         string
+	Genres        []string // movie must have all of these genres
+	GenresAny     []string // movie must have at least one of these genres
+	GenresExclude []string // movie must have none of these genres
+	YearMin       int
+	YearMax       int
+	RuntimeMin    int
+	RuntimeMax    int
+	CreatedSince  time.Time
+}
+
+// Checks that the MovieFilters struct contains sensible values. Note that the zero
+// values are allowed, as they mean that the corresponding filter isn't applied.
+func ValidateMovieFilters(v *validator.Validator, f MovieFilters) {
+	currentYear := time.Now().Year()
+
+	if f.YearMin != 0 {
+		v.Check(f.YearMin >= 1888, "year_min", "must be greater than 1888")
+		v.Check(f.YearMin <= currentYear, "year_min", "must not be in the future")
+	}
+	if f.YearMax != 0 {
+		v.Check(f.YearMax >= 1888, "year_max", "must be greater than 1888")
+		v.Check(f.YearMax <= currentYear, "year_max", "must not be in the future")
+	}
+	if f.YearMin != 0 && f.YearMax != 0 {
+		v.Check(f.YearMin <= f.YearMax, "year_max", "must not be less than year_min")
+	}
+
+	if f.RuntimeMin != 0 {
+		v.Check(f.RuntimeMin > 0, "runtime_min", "must be a positive integer")
+	}
+	if f.RuntimeMax != 0 {
+		v.Check(f.RuntimeMax > 0, "runtime_max", "must be a positive integer")
+	}
+	if f.RuntimeMin != 0 && f.RuntimeMax != 0 {
+		v.Check(f.RuntimeMin <= f.RuntimeMax, "runtime_max", "must not be less than runtime_min")
+	}
+
+	v.Check(len(f.GenresAny) <= 20, "genres_any", "must not contain more than 20 genres")
+	v.Check(len(f.GenresExclude) <= 20, "genres_exclude", "must not contain more than 20 genres")
+
+	if !f.CreatedSince.IsZero() {
+		v.Check(!f.CreatedSince.After(time.Now()), "created_since", "must not be in the future")
+	}
+}
+
+// Appends a value to the args slice and returns the placeholder (like "$3") which
+// refers to it in the SQL query.
+func addArg(args *[]any, value any) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+// Builds the WHERE clause for the filters. Every client-provided value is appended to
+// the args slice and referenced in the SQL by its placeholder number, so the only
+// thing we ever interpolate into the query string is the placeholder itself. The
+// returned clause is always valid SQL, even when no filters are set.
+func (f MovieFilters) where(args *[]any) string {
+	conditions := []string{}
+
+	// A movie matches the title filter if either every word in the filter is a prefix
+	// of a word in the title (so "godfa" finds "The Godfather"), or if the filter is
+	// similar enough to a part of the title according to pg_trgm's word similarity
+	// (so the typo in "godfater" still finds it). Both conditions can use an index:
+	// movies_title_idx and movies_title_trgm_idx respectively.
+	if f.Title != "" {
+		conditions = append(conditions, fmt.Sprintf(
+			"(to_tsvector('simple', title) @@ to_tsquery('simple', %s) OR %s <%% title)",
+			addArg(args, prefixTSQuery(f.Title)), addArg(args, f.Title),
+		))
+	}
+	if len(f.Genres) > 0 {
+		conditions = append(conditions, fmt.Sprintf("genres @> %s", addArg(args, pq.Array(f.Genres))))
+	}
+	if len(f.GenresAny) > 0 {
+		conditions = append(conditions, fmt.Sprintf("genres && %s", addArg(args, pq.Array(f.GenresAny))))
+	}
+	if len(f.GenresExclude) > 0 {
+		conditions = append(conditions, fmt.Sprintf("NOT genres && %s", addArg(args, pq.Array(f.GenresExclude))))
+	}
+	if f.YearMin != 0 {
+		conditions = append(conditions, fmt.Sprintf("year >= %s", addArg(args, f.YearMin)))
+	}
+	if f.YearMax != 0 {
+		conditions = append(conditions, fmt.Sprintf("year <= %s", addArg(args, f.YearMax)))
+	}
+	if f.RuntimeMin != 0 {
+		conditions = append(conditions, fmt.Sprintf("runtime >= %s", addArg(args, f.RuntimeMin)))
+	}
+	if f.RuntimeMax != 0 {
+		conditions = append(conditions, fmt.Sprintf("runtime <= %s", addArg(args, f.RuntimeMax)))
+	}
+	if !f.CreatedSince.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("created_at >= %s", addArg(args, f.CreatedSince)))
+	}
+
+	if len(conditions) == 0 {
+		return "TRUE"
+	}
+
+	return strings.Join(conditions, "\n        AND ")
+}
+
+// Builds the SQL expression for the relevance of a movie to the title filter, which is
+// used when sorting the results by relevance. It combines the full-text search rank
+// of the prefix query with the trigram word similarity, so that exact word matches
+// are ranked above fuzzy ones. If there is no title filter all movies are equally
+// relevant.
+func (f MovieFilters) relevance(args *[]any) string {
+	if f.Title == "" {
+		return "0"
+	}
+
+	return fmt.Sprintf(
+		"ts_rank(to_tsvector('simple', title), to_tsquery('simple', %s)) + word_similarity(%s, title)",
+		addArg(args, prefixTSQuery(f.Title)), addArg(args, f.Title),
+	)
+}
+
+// Converts the client-provided title filter into a tsquery string where every word is
+// treated as a prefix, like "the:* & godfa:*". Anything other than letters and digits
+// is stripped out first, so that the resulting string is always a valid tsquery and
+// can't contain any of the tsquery operators. If no words are left, then we return
+// an empty string: PostgreSQL treats it as an empty query which doesn't match anything,
+// leaving it to the trigram similarity check.
+func prefixTSQuery(title string) string {
+	words := strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i := range words {
+		words[i] = words[i] + ":*"
+	}
+
+	return strings.Join(words, " & ")
+}
+
 // The GetAll() method accepts the filter and sort parameters, fetches
 // the list of records from the database and returns a slice of pointers
 // to the Movie struct and the pagination Metadata struct.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	// Construct the SQL query to retrieve all movie records with filter conditions
-	// and full-text search for the title filter.
+//
+// Two kinds of pagination are supported. The classic page-based one uses LIMIT and
+// OFFSET, which means that PostgreSQL still has to read (and throw away) all the rows
+// before the requested page, so it gets slower the deeper you go. Keyset pagination
+// uses a cursor pointing to the edge of the previous page instead, and filters on the
+// sort column and ID, so every page is as fast as the first. The total number of
+// records is only counted if filters.IncludeTotal is set, as that requires reading all
+// the matching rows too.
+func (m MovieModel) GetAll(movieFilters MovieFilters, filters Filters) ([]*Movie, Metadata, error) {
+	// Build the WHERE clause from the movie filters. This also collects the values
+	// for its placeholders in the args slice.
+	args := []any{}
+	where := movieFilters.where(&args)
+
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	// Keep the WHERE clause for the filters alone, for counting the total records.
+	filterWhere := where
+
+	// If there is a cursor, add the keyset condition to the WHERE clause. The cursor has
+	// already been checked by ValidateFilters(), so we can ignore the error here. For
+	// a cursor pointing to the previous page we need to walk the list backwards, so we
+	// flip the sort direction (we will put the results back in order below).
+	var c cursor
+	if filters.Cursor != "" {
+		c, _ = decodeCursor(filters.Cursor)
+		where = fmt.Sprintf("%s\n        AND %s", where, c.condition(column, direction, &args))
+	}
+
+	idDirection := "ASC"
+	if c.Prev {
+		direction, idDirection = reverseDirection(direction), "DESC"
+	}
+
+	// Sorting by relevance is a special case: the sort value doesn't correspond to
+	// a column, but to an expression calculated in the query, and the most relevant
+	// movies should come first.
+	relevance := movieFilters.relevance(&args)
+	orderBy := fmt.Sprintf("%s %s", column, direction)
+	if filters.Sort == "relevance" {
+		orderBy = "relevance DESC"
+	}
+
+	// Subquery which counts the total (filtered) records for pagination, if the client
+	// asked for it. It uses the WHERE clause without the keyset condition (which would
+	// only count the records after the cursor, so fewer on every page), and its
+	// placeholders refer to the same args.
+	total := "0"
+	if filters.IncludeTotal {
+		total = fmt.Sprintf("(SELECT count(*) FROM movies WHERE %s)", filterWhere)
+	}
+
+	// Construct the SQL query to retrieve all movie records matching the filter
+	// conditions (including the full-text search for the title filter).
 	// Add an ORDER BY clause and interpolate the sort column and direction.
 	// A secondary sort on the movie ID to ensure consistent ordering.
-	// LIMIT and OFFSET clauses with placeholder parameter values for pagination.
-	// Window function which counts the total (filtered) records for pagination.
+	// LIMIT and OFFSET clauses with placeholder parameter values for pagination. We call
+	// the limit() and offset() methods on the Filters struct to get the appropriate
+	// values for them. Note that we ask for one more record than the page size: if we
+	// get it, we know that there is another page after this one.
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+        SELECT %s, id, created_at, title, year, runtime, genres, version,
+            %s AS relevance
         FROM movies
-        WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
-        AND (genres @> $2 OR $2 = '{}')     
-        ORDER BY %s %s, id ASC
-        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+        WHERE %s
+        ORDER BY %s, id %s
+        LIMIT %s OFFSET %s`,
+		total, relevance, where, orderBy, idDirection,
+		addArg(&args, filters.limit()+1), addArg(&args, filters.offset()))
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
-	// Collect the values for the placeholders in a slice. We call the limit() and
-	// offset() methods on the Filters struct to get the appropriate values for the
-	// LIMIT and OFFSET clauses.
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
-
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
@@ -287,12 +580,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// Use rows.Next to iterate through the rows in the resultset.
 	for rows.Next() {
 		// Initialize an empty Movie struct to hold the data for an individual movie.
+		// The relevance score is only used for ordering, so we discard it.
 		var movie Movie
+		var relevanceScore float64
 
 		// Scan the values from the row into the Movie struct. Again, note that we're
 		// using the pq.Array() adapter on the genres field here.
 		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords.
+			&totalRecords, // Scan the count from the subquery into totalRecords.
 			&movie.ID,
 			&movie.CreatedAt,
 			&movie.Title,
@@ -300,6 +595,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&relevanceScore,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -315,10 +611,214 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		return nil, Metadata{}, err
 	}
 
+	// Drop the extra record if we got it, remembering that there are more records in
+	// the direction we were going.
+	hasMore := len(movies) > filters.limit()
+	if hasMore {
+		movies = movies[:filters.limit()]
+	}
+
+	// If we walked the list backwards, put the movies back in the requested order.
+	if c.Prev {
+		slices.Reverse(movies)
+	}
+
 	// Generate a Metadata struct, passing in the total record count and pagination
-	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// parameters from the client. The page numbers only make sense for page-based
+	// pagination.
+	var metadata Metadata
+	switch {
+	case filters.Cursor != "":
+		metadata = Metadata{PageSize: filters.PageSize, TotalRecords: totalRecords}
+	case filters.IncludeTotal:
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	default:
+		metadata = Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1}
+	}
+
+	// Add the cursors for the neighbouring pages. There is a next page if we found more
+	// records going forwards, or if we came here backwards from it, and vice versa for
+	// the previous page. Relevance isn't a column which we can filter on, so there is
+	// no keyset pagination when sorting by it.
+	if len(movies) > 0 && filters.Sort != "relevance" {
+		hasNext, hasPrev := hasMore, filters.Cursor != "" || filters.Page > 1
+		if c.Prev {
+			hasNext, hasPrev = true, hasMore
+		}
+
+		if hasNext {
+			last := movies[len(movies)-1]
+			metadata.NextCursor = cursor{Sort: filters.Sort, Value: last.sortValue(column), ID: last.ID}.encode()
+		}
+		if hasPrev {
+			first := movies[0]
+			metadata.PrevCursor = cursor{Sort: filters.Sort, Value: first.sortValue(column), ID: first.ID, Prev: true}.encode()
+		}
+	}
 
 	// If everything went OK, then return the slice of movies and pagination metadata.
 	return movies, metadata, nil
 }
+
+// Returns the value of the given sort column for the movie, for use in a pagination
+// cursor.
+func (movie *Movie) sortValue(column string) any {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return int64(movie.Year)
+	case "runtime":
+		return int64(movie.Runtime)
+	default:
+		return movie.ID
+	}
+}
+
+// MovieSuggestion is the lightweight representation of a movie returned by the title
+// autocomplete, containing just enough to render a suggestion and link to the movie.
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+// The Suggest() method returns up to limit movies whose titles best match the
+// (possibly partial) query typed by the user. It uses the same prefix and trigram
+// matching as the title filter in GetAll(), always ordered by relevance, and only
+// selects the columns needed for the suggestions to keep it cheap enough to be called
+// on every keystroke.
+func (m MovieModel) Suggest(query string, limit int) ([]*MovieSuggestion, error) {
+	movieFilters := MovieFilters{Title: query}
+
+	args := []any{}
+	where := movieFilters.where(&args)
+	relevance := movieFilters.relevance(&args)
+
+	sqlQuery := fmt.Sprintf(`
+        SELECT id, title, year
+        FROM movies
+        WHERE %s
+        ORDER BY %s DESC, id ASC
+        LIMIT %s`, where, relevance, addArg(&args, limit))
+
+	// Suggestions which arrive late are useless, so we use a tighter 1-second timeout
+	// here instead of our usual 3 seconds.
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*MovieSuggestion{}
+
+	for rows.Next() {
+		var suggestion MovieSuggestion
+
+		err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year)
+		if err != nil {
+			return nil, err
+		}
+
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// The Export() method streams all the movies matching the filters, in the given sort
+// order, to the fn callback in batches of up to batchSize movies. Rather than loading
+// everything at once, it declares a server-side cursor in a read-only transaction and
+// fetches from it one batch at a time, so the memory used doesn't depend on the size of
+// the catalogue. An export can legitimately take a long time, so instead of our usual
+// 3-second timeout it uses the provided context (typically the request context, so the
+// export stops if the client goes away). If fn returns an error, the export stops and
+// that error is returned.
+func (m MovieModel) Export(ctx context.Context, movieFilters MovieFilters, filters Filters, batchSize int, fn func([]*Movie) error) error {
+	args := []any{}
+	where := movieFilters.where(&args)
+
+	query := fmt.Sprintf(`
+        DECLARE movies_export NO SCROLL CURSOR FOR
+        SELECT id, created_at, title, year, runtime, genres, version
+        FROM movies
+        WHERE %s
+        ORDER BY %s %s, id ASC`, where, filters.sortColumn(), filters.sortDirection())
+
+	// Cursors only exist within a transaction. It is read-only, so PostgreSQL doesn't
+	// need to worry about us changing anything while we're reading.
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+
+	// Nothing is written, so rolling back at the end is as good as committing, and it
+	// also closes the cursor.
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM movies_export", batchSize)
+
+	for {
+		movies, err := fetchMovies(ctx, tx, fetch)
+		if err != nil {
+			return err
+		}
+
+		// An empty batch means that the cursor is exhausted.
+		if len(movies) == 0 {
+			return nil
+		}
+
+		err = fn(movies)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Runs a query returning whole movie records (like a FETCH from a cursor) in the
+// transaction and scans the results into a slice of movies.
+func fetchMovies(ctx context.Context, tx *sql.Tx, query string) ([]*Movie, error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
@@ -0,0 +1,265 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// Constants for the delivery status of an email in the outbox. An email starts off as
+// pending, is sending while a worker is delivering it, and ends up either sent or, once
+// it has run out of attempts, failed. An email whose delivery attempt fails but which
+// has attempts left goes back to pending.
+const (
+	EmailPending = "pending"
+	EmailSending = "sending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// Email struct to hold an outgoing email in the outbox. Rather than the rendered
+// message, it holds the name of the template and the data for it, which are passed to
+// the mailer when the email is delivered. The data often contains secrets like
+// activation tokens, so it is never included in the JSON output, and it is cleared
+// once the email has been sent or has failed for good.
+type Email struct {
+	ID            int64          `json:"id"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	Recipient     string         `json:"recipient"`
+	Locale        string         `json:"locale"`
+	Template      string         `json:"template"`
+	Data          map[string]any `json:"-"`
+	Status        string         `json:"status"`
+	Attempts      int            `json:"attempts"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	LastError     string         `json:"last_error,omitempty"`
+	SentAt        *time.Time     `json:"sent_at,omitempty"`
+}
+
+// Define the EmailOutboxModel type.
+type EmailOutboxModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// Adds an email to the outbox as part of the given transaction, so that the email is
+// only queued if everything else in the transaction succeeds (and is never lost if it
+// does).
+func insertEmail(ctx context.Context, tx *sql.Tx, email *Email) error {
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO email_outbox (recipient, locale, template, data)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, updated_at, status, next_attempt_at`
+
+	// Note that we pass the JSON as a string: lib/pq sends []byte values in the binary
+	// format, which PostgreSQL doesn't accept for jsonb columns.
+	args := []any{email.Recipient, email.Locale, email.Template, string(js)}
+
+	return tx.QueryRowContext(ctx, query, args...).
+		Scan(&email.ID, &email.CreatedAt, &email.UpdatedAt, &email.Status, &email.NextAttemptAt)
+}
+
+// Claims the next email which is due to be delivered, marking it as sending and
+// counting the attempt. If there is no such email, it returns ErrRecordNotFound. This
+// works in the same way as JobModel.Claim(): the FOR UPDATE SKIP LOCKED makes sure that
+// concurrent workers never get the same email, and the lease means that an email whose
+// worker crashed while sending it is picked up again later.
+//
+// Only emails with fewer than maxAttempts attempts are claimed. Like a job, an email
+// whose lease expired on its last attempt (or which has no attempts left, because the
+// limit was lowered) is marked as failed for good by the same statement instead, and
+// its template data is cleared.
+func (m EmailOutboxModel) Claim(lease time.Duration, maxAttempts int) (*Email, error) {
+	query := `
+        WITH abandoned AS (
+            UPDATE email_outbox
+            SET status = 'failed', data = '{}', updated_at = NOW(),
+                last_error = CASE WHEN status = 'sending' THEN 'lease expired on the last attempt' ELSE last_error END
+            WHERE id IN (
+                SELECT id
+                FROM email_outbox
+                WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW() AND attempts >= $2
+                FOR UPDATE SKIP LOCKED
+            )
+        )
+        UPDATE email_outbox
+        SET status = 'sending', attempts = attempts + 1,
+            next_attempt_at = NOW() + make_interval(secs => $1), updated_at = NOW()
+        WHERE id = (
+            SELECT id
+            FROM email_outbox
+            WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW() AND attempts < $2
+            ORDER BY next_attempt_at, id
+            FOR UPDATE SKIP LOCKED
+            LIMIT 1
+        )
+        RETURNING id, created_at, updated_at, recipient, locale, template, data, status, attempts,
+            next_attempt_at, COALESCE(last_error, ''), sent_at`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	var email Email
+	var data []byte
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Seconds(), maxAttempts).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.UpdatedAt,
+		&email.Recipient,
+		&email.Locale,
+		&email.Template,
+		&data,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+		&email.SentAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(data, &email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// Marks an email as sent, clearing the template data as it is no longer needed.
+func (m EmailOutboxModel) MarkSent(email *Email) error {
+	query := `
+        UPDATE email_outbox
+        SET status = 'sent', data = '{}', last_error = NULL, sent_at = NOW(), updated_at = NOW()
+        WHERE id = $1
+        RETURNING sent_at`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email.ID).Scan(&email.SentAt)
+	if err != nil {
+		return err
+	}
+
+	email.Status, email.Data = EmailSent, nil
+	return nil
+}
+
+// Records a failed delivery attempt. If the email has attempts left (out of
+// maxAttempts), it goes back to pending to be retried after the given delay;
+// otherwise it is marked as failed for good, and like a sent email its template data
+// is cleared, since it will never be needed again.
+func (m EmailOutboxModel) MarkFailed(email *Email, sendErr error, maxAttempts int, retryAfter time.Duration) error {
+	status := EmailPending
+	if email.Attempts >= maxAttempts {
+		status = EmailFailed
+	}
+
+	query := `
+        UPDATE email_outbox
+        SET status = $1, last_error = $2, next_attempt_at = NOW() + make_interval(secs => $3),
+            data = CASE WHEN $1 = 'failed' THEN '{}' ELSE data END, updated_at = NOW()
+        WHERE id = $4`
+
+	args := []any{status, sendErr.Error(), retryAfter.Seconds(), email.ID}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	email.Status, email.LastError = status, sendErr.Error()
+	if status == EmailFailed {
+		email.Data = nil
+	}
+
+	return nil
+}
+
+// Checks that the status filter for the outbox list is one of the known statuses (or
+// empty, meaning all of them).
+func ValidateEmailStatus(v *validator.Validator, status string) {
+	if status != "" {
+		v.Check(validator.PermittedValue(status, EmailPending, EmailSending, EmailSent, EmailFailed), "status", "invalid status value")
+	}
+}
+
+// Returns a page of the emails in the outbox, optionally only those with the given
+// status, along with the pagination metadata. This is what administrators use to
+// check on the delivery of emails.
+func (m EmailOutboxModel) GetAll(status string, filters Filters) ([]*Email, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, updated_at, recipient, locale, template, status,
+            attempts, next_attempt_at, COALESCE(last_error, ''), sent_at
+        FROM email_outbox
+        WHERE (status = $1 OR $1 = '')
+        ORDER BY %s %s, id ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	args := []any{status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.CreatedAt,
+			&email.UpdatedAt,
+			&email.Recipient,
+			&email.Locale,
+			&email.Template,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, &email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return emails, metadata, nil
+}
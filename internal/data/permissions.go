@@ -21,7 +21,8 @@ func (p Permissions) Include(code string) bool {
 
 // Define the PermissionModel type.
 type PermissionModel struct {
-	DB *sql.DB
+	DB  *sql.DB
+	ctx context.Context
 }
 
 // Returns all permission codes for a specific user in a Permissions slice.
@@ -33,7 +34,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
         INNER JOIN users ON users_permissions.user_id = users.id
         WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -63,19 +64,87 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 
 // Add the provided permission codes for a specific user.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	return addPermissions(ctx, m.DB, userID, codes)
+}
+
+// The subset of *sql.DB and *sql.Tx that addPermissions() needs, so that permissions
+// can be granted either on their own or as part of a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Grants the permission codes to the user with the given *sql.DB or *sql.Tx. This is
+// shared by AddForUser() and by UserModel's Register() and Create(), which grant the
+// permissions of a new user in the transaction which inserts them.
+func addPermissions(ctx context.Context, e execer, userID int64, codes []string) error {
 	// In this query the $1 parameter is the user’s ID, and the $2 parameter is a
 	// PostgreSQL array of the permission codes that we want to add for the user,
 	// like {'movies:read', 'movies:write'}. The SELECT ... statement on the second line
 	// creates an ‘interim’ table with rows made up of the user ID and the corresponding
 	// IDs for the permission codes in the array. Then we insert the contents of this
 	// interim table into our user_permissions table.
+	// Permissions which the user already has are skipped, so granting a permission twice
+	// isn't an error.
 	query := `
         INSERT INTO users_permissions
-        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	_, err := e.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// Removes the provided permission codes from a specific user. Codes which the user
+// doesn't have are ignored.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+        DELETE FROM users_permissions
+        USING permissions
+        WHERE users_permissions.permission_id = permissions.id
+        AND users_permissions.user_id = $1
+        AND permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// Returns all the permission codes which exist, in alphabetical order.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+        SELECT code
+        FROM permissions
+        ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,43 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SchemaModel reads the version of the database schema, which the migrations record in
+// the schema_migrations table.
+type SchemaModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// Returns the version of the latest migration applied to the database, and whether it
+// is dirty (i.e. it failed partway through, and the schema needs fixing by hand). If
+// no migrations have been applied, the version is 0.
+func (m SchemaModel) Version() (int64, bool, error) {
+	query := `
+        SELECT version, dirty
+        FROM schema_migrations
+        LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	var version int64
+	var dirty bool
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
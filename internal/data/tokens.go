@@ -90,7 +90,8 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB  *sql.DB
+	ctx context.Context
 }
 
 // A TokenModel struct method. A shortcut which creates a new Token struct and then
@@ -105,6 +106,43 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// Like New(), but also queues the email built by the email function (which is passed
+// the new token, so it can include the plaintext) in the email outbox. The token and
+// the email are stored in a single transaction, so a token is never created without
+// the email which delivers it to the user.
+func (m TokenModel) NewWithEmail(userID int64, ttl time.Duration, scope string, email func(*Token) *Email) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertEmail(ctx, tx, email(token))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
 // Adds the data for a specific token to the tokens db table.
 func (m TokenModel) Insert(token *Token) error {
 	query := `
@@ -113,22 +151,70 @@ func (m TokenModel) Insert(token *Token) error {
 
 	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
+// The same as Insert(), but as part of the given transaction.
+func insertToken(ctx context.Context, tx *sql.Tx, token *Token) error {
+	query := `
+        INSERT INTO tokens (hash, user_id, expiry, scope) 
+        VALUES ($1, $2, $3, $4)`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
 // Deletes all tokens for a specific user and scope.
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `
         DELETE FROM tokens 
         WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Deletes all tokens for a specific user, whatever their scope, and returns the number
+// of tokens deleted. This signs the user out everywhere.
+func (m TokenModel) DeleteAllScopesForUser(userID int64) (int64, error) {
+	query := `
+        DELETE FROM tokens 
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Deletes all the tokens which have expired, and returns the number of tokens deleted.
+// Expired tokens are never accepted, so this only keeps the table from growing.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	query := `
+        DELETE FROM tokens 
+        WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -29,6 +29,7 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Locale    string    `json:"locale"`
 	Version   int       `json:"-"`
 }
 
@@ -94,6 +95,14 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
 
+// Checks that the locale looks like a BCP 47 language tag with an optional region,
+// e.g. "en" or "pt-BR". Whether we actually have email templates for the locale is up
+// to the mailer, which falls back to the default templates if we don't.
+func ValidateLocale(v *validator.Validator, locale string) {
+	v.Check(locale != "", "locale", "must be provided")
+	v.Check(validator.Matches(locale, validator.LocaleRX), "locale", "must be a valid language tag")
+}
+
 // Checks that the User struct contains valid data.
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
@@ -102,6 +111,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
 
+	ValidateLocale(v, user.Locale)
+
 	// If the plaintext password is not nil, call the standalone
 	// ValidatePasswordPlaintext() helper.
 	if user.Password.plaintext != nil {
@@ -120,28 +131,41 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // Create a UserModel struct which wraps the connection pool.
 type UserModel struct {
-	DB *sql.DB
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// The subset of *sql.DB and *sql.Tx that insertUser() needs, so that a user can be
+// inserted either on its own or as part of a transaction.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
 // Inserts a new record in the database for the user. Note that the id, created_at and
 // version fields are all automatically generated by our database, so we use the
 // RETURNING clause to read them into the User struct after the insert.
 func (m UserModel) Insert(user *User) error {
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+// Inserts the user record with the given *sql.DB or *sql.Tx. This is shared by
+// Insert(), Register() and Create().
+func insertUser(ctx context.Context, q queryer, user *User) error {
 	query := `
-        INSERT INTO users (name, email, password_hash, activated) 
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO users (name, email, password_hash, activated, locale) 
+        VALUES ($1, $2, $3, $4, $5)
         RETURNING id, created_at, version`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Locale}
 
 	// If the table already contains a record with this email address, then when we try
 	// to perform the insert there will be a violation of the UNIQUE "users_email_key"
 	// constraint that we set up in the previous chapter. We check for this error
 	// specifically, and return custom ErrDuplicateEmail error instead.
-	err := m.DB.QueryRowContext(ctx, query, args...).
+	err := q.QueryRowContext(ctx, query, args...).
 		Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
@@ -155,18 +179,140 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Registers a new user: inserts the user record, grants them the given permissions,
+// creates an activation token, and queues the welcome email built by the welcome
+// function (which is passed the token, so it can include the plaintext in the email).
+// All of this happens in a single transaction, so we never end up with a user who
+// has no way of activating their account because the email was lost, or with an email
+// for a user who doesn't exist.
+func (m UserModel) Register(user *User, permissionCodes []string, activationTTL time.Duration, welcome func(*Token) *Email) (*Token, error) {
+	token, err := generateToken(0, activationTTL, ScopeActivation)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addPermissions(ctx, tx, user.ID, permissionCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserID = user.ID
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertEmail(ctx, tx, welcome(token))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Inserts a new user and grants them the given permissions, in a single transaction.
+// Unlike Register(), no activation token or welcome email is created, so this is for
+// creating users (like the first administrator) outside of the API.
+func (m UserModel) Create(user *User, permissionCodes []string) error {
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	err = addPermissions(ctx, tx, user.ID, permissionCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Retrieves all the users, in the order they were created. This is for the
+// administrative tools, which list every user, so it isn't paginated.
+func (m UserModel) GetAll() ([]*User, error) {
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, locale, version
+        FROM users
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Locale,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 // Retrieves the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, password_hash, activated, locale, version
         FROM users
         WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -176,6 +322,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 
@@ -197,8 +344,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
         UPDATE users 
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5, version = version + 1
+        WHERE id = $6 AND version = $7
         RETURNING version`
 
 	args := []any{
@@ -206,11 +353,12 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -236,7 +384,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	// Set up the SQL query.
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -252,7 +400,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching
@@ -264,6 +412,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 	if err != nil {
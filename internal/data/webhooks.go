@@ -0,0 +1,487 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.mazavrbazavr.ru/internal/validator"
+)
+
+// The events which webhooks can subscribe to.
+const (
+	EventMovieCreated  = "movie.created"
+	EventMovieUpdated  = "movie.updated"
+	EventMovieDeleted  = "movie.deleted"
+	EventUserActivated = "user.activated"
+)
+
+var WebhookEvents = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted, EventUserActivated}
+
+// Constants for the status of a webhook delivery, which follow the same life cycle as
+// the emails in the outbox.
+const (
+	DeliveryPending   = "pending"
+	DeliverySending   = "sending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook struct to hold a webhook subscription: the URL which the events are POSTed
+// to, and the events it is subscribed to. The secret is used to sign the deliveries,
+// so that the receiver can check that they came from us. It is only included in the
+// JSON output when the webhook is created.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// Delivery struct to hold a single delivery of an event to a webhook. The URL and
+// secret of the webhook are filled in when the delivery is claimed for sending.
+type Delivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	URL            string          `json:"-"`
+	Secret         string          `json:"-"`
+}
+
+// Generates a random secret for signing the deliveries of a webhook.
+func GenerateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(randomBytes), nil
+}
+
+// Checks that the Webhook struct contains valid data.
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	// The secret is only set when a webhook is created or its secret is changed.
+	if webhook.Secret != "" {
+		v.Check(len(webhook.Secret) >= 16, "secret", "must be at least 16 bytes long")
+		v.Check(len(webhook.Secret) <= 200, "secret", "must not be more than 200 bytes long")
+	}
+
+	v.Check(webhook.Events != nil, "events", "must be provided")
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+
+	for _, event := range webhook.Events {
+		v.Check(validator.PermittedValue(event, WebhookEvents...), "events", fmt.Sprintf("unknown event %q", event))
+	}
+}
+
+// Define the WebhookModel type.
+type WebhookModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// Inserts a new webhook subscription.
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+        INSERT INTO webhooks (url, secret, events, active)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, version`
+
+	args := []any{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Retrieves a specific webhook. The secret is left out.
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, url, events, active, version
+        FROM webhooks
+        WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// Retrieves all the webhooks, ordered by ID. The secrets are left out.
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+        SELECT id, created_at, url, events, active, version
+        FROM webhooks
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Updates the URL, events and active flag of a webhook, using the version for
+// optimistic locking in the same way as MovieModel.Update(). The secret is only
+// updated if a new one is set.
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+        UPDATE webhooks
+        SET url = $1, events = $2, active = $3, secret = COALESCE(NULLIF($4, ''), secret),
+            version = version + 1
+        WHERE id = $5 AND version = $6
+        RETURNING version`
+
+	args := []any{webhook.URL, pq.Array(webhook.Events), webhook.Active, webhook.Secret, webhook.ID, webhook.Version}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Deletes a webhook, along with its deliveries.
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+        DELETE FROM webhooks
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Queues a delivery of the event to every active webhook subscribed to it, one for
+// each of the payloads (which are encoded to JSON). The payloads are passed to
+// PostgreSQL as a single array, so that this is one query however many there are.
+func (m WebhookModel) Enqueue(event string, payloads ...any) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	encoded := make([]string, len(payloads))
+	for i, payload := range payloads {
+		js, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		encoded[i] = string(js)
+	}
+
+	query := `
+        INSERT INTO webhook_deliveries (webhook_id, event, payload)
+        SELECT webhooks.id, $1, payloads.payload::jsonb
+        FROM webhooks, unnest($2::text[]) WITH ORDINALITY AS payloads(payload, n)
+        WHERE webhooks.active AND $1 = ANY(webhooks.events)
+        ORDER BY payloads.n, webhooks.id`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, event, pq.Array(encoded))
+	return err
+}
+
+// Claims the next delivery which is due, marking it as sending and counting the
+// attempt, in the same way as EmailOutboxModel.Claim(): only deliveries with fewer than
+// maxAttempts attempts are claimed, and those whose lease expired on their last attempt
+// are marked as failed. The URL and secret of the webhook are returned with the
+// delivery. If there is no such delivery, it returns ErrRecordNotFound.
+func (m WebhookModel) ClaimDelivery(lease time.Duration, maxAttempts int) (*Delivery, error) {
+	query := `
+        WITH abandoned AS (
+            UPDATE webhook_deliveries
+            SET status = 'failed', updated_at = NOW(),
+                last_error = CASE WHEN status = 'sending' THEN 'lease expired on the last attempt' ELSE last_error END
+            WHERE id IN (
+                SELECT id
+                FROM webhook_deliveries
+                WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW() AND attempts >= $2
+                FOR UPDATE SKIP LOCKED
+            )
+        ),
+        claimed AS (
+            UPDATE webhook_deliveries
+            SET status = 'sending', attempts = attempts + 1,
+                next_attempt_at = NOW() + make_interval(secs => $1), updated_at = NOW()
+            WHERE id = (
+                SELECT id
+                FROM webhook_deliveries
+                WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW() AND attempts < $2
+                ORDER BY next_attempt_at, id
+                FOR UPDATE SKIP LOCKED
+                LIMIT 1
+            )
+            RETURNING *
+        )
+        SELECT claimed.id, claimed.created_at, claimed.updated_at, claimed.webhook_id,
+            claimed.event, claimed.payload, claimed.status, claimed.attempts,
+            claimed.next_attempt_at, COALESCE(claimed.response_status, 0),
+            COALESCE(claimed.last_error, ''), claimed.delivered_at, webhooks.url, webhooks.secret
+        FROM claimed
+        INNER JOIN webhooks ON webhooks.id = claimed.webhook_id`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	var delivery Delivery
+	var payload []byte
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Seconds(), maxAttempts).Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.DeliveredAt,
+		&delivery.URL,
+		&delivery.Secret,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	delivery.Payload = payload
+	return &delivery, nil
+}
+
+// Marks a delivery as succeeded, recording the HTTP status code of the response. If the
+// delivery is no longer held by this attempt (because its lease expired and it was
+// claimed again, or marked as failed), it returns ErrRecordNotFound and leaves the
+// delivery alone.
+func (m WebhookModel) MarkDelivered(delivery *Delivery, responseStatus int) error {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = 'succeeded', response_status = $1, last_error = NULL, delivered_at = NOW(),
+            updated_at = NOW()
+        WHERE id = $2 AND status = 'sending' AND attempts = $3
+        RETURNING delivered_at`
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, responseStatus, delivery.ID, delivery.Attempts).Scan(&delivery.DeliveredAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	delivery.Status, delivery.ResponseStatus = DeliverySucceeded, responseStatus
+	return nil
+}
+
+// Records a failed delivery attempt, along with the HTTP status code of the response
+// (or 0 if there wasn't one). If the delivery has attempts left (out of maxAttempts),
+// it goes back to pending to be retried after the given delay; otherwise it is marked
+// as failed for good. Like MarkDelivered(), it returns ErrRecordNotFound if the
+// delivery is no longer held by this attempt.
+func (m WebhookModel) MarkFailed(delivery *Delivery, responseStatus int, deliveryErr error, maxAttempts int, retryAfter time.Duration) error {
+	status := DeliveryPending
+	if delivery.Attempts >= maxAttempts {
+		status = DeliveryFailed
+	}
+
+	query := `
+        UPDATE webhook_deliveries
+        SET status = $1, response_status = NULLIF($2, 0), last_error = $3,
+            next_attempt_at = NOW() + make_interval(secs => $4), updated_at = NOW()
+        WHERE id = $5 AND status = 'sending' AND attempts = $6`
+
+	args := []any{status, responseStatus, deliveryErr.Error(), retryAfter.Seconds(), delivery.ID, delivery.Attempts}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	err := execOnClaimed(ctx, m.DB, query, args...)
+	if err != nil {
+		return err
+	}
+
+	delivery.Status, delivery.ResponseStatus, delivery.LastError = status, responseStatus, deliveryErr.Error()
+	return nil
+}
+
+// Returns a page of the delivery log for a webhook, newest first, along with the
+// pagination metadata.
+func (m WebhookModel) GetDeliveries(webhookID int64, filters Filters) ([]*Delivery, Metadata, error) {
+	query := `
+        SELECT count(*) OVER(), id, created_at, updated_at, webhook_id, event, payload, status,
+            attempts, next_attempt_at, COALESCE(response_status, 0), COALESCE(last_error, ''),
+            delivered_at
+        FROM webhook_deliveries
+        WHERE webhook_id = $1
+        ORDER BY id DESC
+        LIMIT $2 OFFSET $3`
+
+	args := []any{webhookID, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(parentContext(m.ctx), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*Delivery{}
+
+	for rows.Next() {
+		var delivery Delivery
+		var payload []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.UpdatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+			&delivery.DeliveredAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		delivery.Payload = payload
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
@@ -2,10 +2,14 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,91 +19,253 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota
 // keyword as a shortcut to assign successive integer values to the constants.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelWarn               // Has the value 2.
+	LevelError              // Has the value 3.
+	LevelFatal              // Has the value 4.
+	LevelOff                // Has the value 5.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
-// Define a custom Logger type. This holds the output destination that the log entries
-// will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// Returns the level with the given name (in any case), e.g. for the -log-level flag.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid log level %q (must be debug, info, warn, error, fatal or off)", s)
+}
+
+// StackTraceMode controls which log entries include a stack trace.
+type StackTraceMode int8
+
+const (
+	StackTracesErrors StackTraceMode = iota // ERROR and FATAL entries (the default).
+	StackTracesFatal                        // FATAL entries only.
+	StackTracesOff                          // No entries.
+)
+
+// Return a human-friendly string for the stack trace mode.
+func (m StackTraceMode) String() string {
+	switch m {
+	case StackTracesErrors:
+		return "errors"
+	case StackTracesFatal:
+		return "fatal"
+	case StackTracesOff:
+		return "off"
+	default:
+		return ""
+	}
+}
+
+// Implements the encoding.TextMarshaler interface, so that a StackTraceMode can be used
+// with flag.TextVar().
+func (m StackTraceMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Implements the encoding.TextUnmarshaler interface.
+func (m *StackTraceMode) UnmarshalText(text []byte) error {
+	for mode := StackTracesErrors; mode <= StackTracesOff; mode++ {
+		if strings.EqualFold(string(text), mode.String()) {
+			*m = mode
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid stack trace mode %q (must be errors, fatal or off)", text)
+}
+
+// Sink is an output destination for the log entries, with its own minimum severity
+// level on top of the logger's (e.g. so that only errors are sent to syslog). If the
+// Writer implements LevelWriter, the entries are written with WriteLevel().
+type Sink struct {
+	Writer   io.Writer
+	MinLevel Level
+}
+
+// LevelWriter is implemented by sinks which need the severity level of each entry,
+// like syslog, which has its own severities.
+type LevelWriter interface {
+	WriteLevel(level Level, p []byte) (int, error)
+}
+
+// Define a custom Logger type. This holds the sinks that the log entries will be
+// written to, the minimum severity level that log entries will be written for, plus a
+// mutex for coordinating the writes. The sinks, level and mutex are shared with the
+// child loggers created by With(), so changing the level of any of them changes it for
+// all of them.
+//
+// Properties are a map of any values, which are written as their JSON encoding (so
+// numbers and booleans stay numbers and booleans), except for errors and durations,
+// which are written as their string form.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	core       *core
+	properties map[string]any
+}
+
+type core struct {
+	sinks       []Sink
+	minLevel    atomic.Int32
+	stackTraces atomic.Int32
+	redactor    atomic.Pointer[Redactor]
+	mu          sync.Mutex
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+	return NewWithSinks(minLevel, Sink{Writer: out, MinLevel: LevelDebug})
+}
+
+// Return a new Logger instance which writes log entries at or above a minimum severity
+// level to each of the sinks whose own minimum level they are also at or above.
+func NewWithSinks(minLevel Level, sinks ...Sink) *Logger {
+	l := &Logger{core: &core{sinks: sinks}}
+	l.core.minLevel.Store(int32(minLevel))
+	return l
+}
+
+// Returns a child logger which adds the given properties to all its log entries (e.g.
+// the request ID for the entries about a request). Properties given when printing an
+// entry take precedence over the bound ones with the same names.
+func (l *Logger) With(properties map[string]any) *Logger {
+	merged := maps.Clone(l.properties)
+	if merged == nil {
+		merged = make(map[string]any, len(properties))
 	}
+	maps.Copy(merged, properties)
+
+	return &Logger{core: l.core, properties: merged}
+}
+
+// Returns the current minimum severity level.
+func (l *Logger) Level() Level {
+	return Level(l.core.minLevel.Load())
+}
+
+// Changes the minimum severity level, for this logger and all the loggers related to it
+// through With(). This is safe to call while entries are being written.
+func (l *Logger) SetLevel(level Level) {
+	l.core.minLevel.Store(int32(level))
+}
+
+// Sets which log entries include a stack trace. Stack traces are large, so in
+// production it may be best to only include them for FATAL entries, or not at all.
+func (l *Logger) SetStackTraces(mode StackTraceMode) {
+	l.core.stackTraces.Store(int32(mode))
+}
+
+// Sets the Redactor which removes sensitive data from the messages and properties of
+// the log entries before they are written, for this logger and all the loggers related
+// to it through With(). A nil Redactor turns redaction off, which is the default.
+func (l *Logger) SetRedactor(r *Redactor) {
+	l.core.redactor.Store(r)
+}
+
+// Reports whether entries at the given level are written, so that callers can skip
+// preparing the properties for entries which would be discarded.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// A helper method for writing log entries at the DEBUG severity level.
+// Accepts a map as the second parameter which can contain any arbitrary
+// 'properties' that you want to appear in the log entry.
+func (l *Logger) PrintDebug(message string, properties map[string]any) {
+	l.print(LevelDebug, message, properties)
 }
 
 // A helper method for writing log entries at the INFO severity level.
 // Accepts a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+func (l *Logger) PrintInfo(message string, properties map[string]any) {
 	l.print(LevelInfo, message, properties)
 }
 
+// A helper method for writing log entries at the WARN severity level, for problems
+// which don't stop anything from working (yet).
+func (l *Logger) PrintWarn(message string, properties map[string]any) {
+	l.print(LevelWarn, message, properties)
+}
+
 // A helper method for writing log entries at the ERROR severity level.
 // Accepts a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
-func (l *Logger) PrintError(err error, properties map[string]string) {
+func (l *Logger) PrintError(err error, properties map[string]any) {
 	l.print(LevelError, err.Error(), properties)
 }
 
 // A helper method for writing log entries at the FATAL severity level.
 // Accepts a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintFatal(err error, properties map[string]any) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
 // Internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, properties map[string]any) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if !l.Enabled(level) {
 		return 0, nil
 	}
 
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: l.merge(properties),
+	}
+
+	// Remove any sensitive data before the entry goes anywhere near the output.
+	if r := l.core.redactor.Load(); r != nil {
+		aux.Message = r.String(aux.Message)
+		aux.Properties = r.Properties(aux.Properties)
 	}
 
-	// Include a stack trace for entries at the ERROR and FATAL levels.
-	if level >= LevelError {
-		aux.Trace = string(debug.Stack())
+	// Include a stack trace for entries at the ERROR and FATAL levels, or just the FATAL
+	// level, depending on the stack trace mode.
+	switch StackTraceMode(l.core.stackTraces.Load()) {
+	case StackTracesErrors:
+		if level >= LevelError {
+			aux.Trace = string(debug.Stack())
+		}
+	case StackTracesFatal:
+		if level >= LevelFatal {
+			aux.Trace = string(debug.Stack())
+		}
 	}
 
 	// Declare a line variable for holding the actual log entry text.
@@ -116,11 +282,62 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	// Lock the mutex so that no two writes to the output destination can happen
 	// concurrently. If we don't do this, it's possible that the text for two or more
 	// log entries will be intermingled in the output.
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+
+	// Write the log entry followed by a newline to each of the sinks it is meant for. A
+	// failing sink doesn't stop the entry from being written to the others; the first
+	// error is returned.
+	line = append(line, '\n')
+
+	var n int
+	var firstErr error
+
+	for _, sink := range l.core.sinks {
+		if level < sink.MinLevel {
+			continue
+		}
+
+		var err error
 
-	// Write the log entry followed by a newline.
-	return l.out.Write(append(line, '\n'))
+		if lw, ok := sink.Writer.(LevelWriter); ok {
+			n, err = lw.WriteLevel(level, line)
+		} else {
+			n, err = sink.Writer.Write(line)
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return n, firstErr
+}
+
+// Returns the bound properties merged with those of the entry, with errors and
+// durations replaced by their string form (the JSON encoding of an error is usually
+// "{}", and that of a duration a number of nanoseconds).
+func (l *Logger) merge(properties map[string]any) map[string]any {
+	if len(l.properties) == 0 && len(properties) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]any, len(l.properties)+len(properties))
+
+	for _, m := range []map[string]any{l.properties, properties} {
+		for key, value := range m {
+			switch v := value.(type) {
+			case error:
+				merged[key] = v.Error()
+			case time.Duration:
+				merged[key] = v.String()
+			default:
+				merged[key] = v
+			}
+		}
+	}
+
+	return merged
 }
 
 // A Write() method on the Logger type so that it satisfies the io.Writer interface.
@@ -128,3 +345,20 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+// Implements the encoding.TextMarshaler interface, so that a Level can be used with
+// flag.TextVar() and encoded as its name in JSON.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Implements the encoding.TextUnmarshaler interface, using ParseLevel().
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+
+	*l = level
+	return nil
+}
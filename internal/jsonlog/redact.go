@@ -0,0 +1,157 @@
+package jsonlog
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The text which redacted values are replaced with.
+const redacted = "[REDACTED]"
+
+// The keys whose values are always redacted, and the patterns which are redacted from
+// any text by the default Redactor: email addresses, and strings which look like our
+// tokens (26 characters of base32, as generated by data.generateToken()).
+var (
+	DefaultRedactedKeys = []string{
+		"password", "token", "secret", "authorization", "cookie", "set-cookie",
+		"api_key", "apikey", "access_token", "refresh_token",
+	}
+	DefaultRedactedPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+		regexp.MustCompile(`\b[A-Z2-7]{26}\b`),
+	}
+)
+
+// Redactor removes sensitive data from the log entries before they are written. It
+// replaces with "[REDACTED]":
+//
+//   - the value of any property whose key is one of the redacted keys, or ends with
+//     one of them after a "_", "-" or "." (so "activation_token" is redacted as well as
+//     "token"), ignoring case;
+//   - "key=value" pairs and JSON "key": "value" members for the redacted keys in any
+//     text, such as the query string of a URL (e.g. "?token=..." becomes
+//     "?token=[REDACTED]") or a request body;
+//   - anything matching one of the patterns, in the message and in all the string
+//     values of the properties, including those nested in maps and slices.
+type Redactor struct {
+	keys     map[string]bool
+	pairs    *regexp.Regexp
+	members  *regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// Returns a new Redactor for the given keys and patterns.
+func NewRedactor(keys []string, patterns []*regexp.Regexp) *Redactor {
+	r := &Redactor{
+		keys:     make(map[string]bool, len(keys)),
+		patterns: patterns,
+	}
+
+	quoted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		r.keys[key] = true
+		quoted = append(quoted, regexp.QuoteMeta(key))
+	}
+
+	if len(quoted) > 0 {
+		// As with the property keys, the keys may have a prefix (e.g. "activation_").
+		key := `(?:[a-z0-9]+[_.\-])*(?:` + strings.Join(quoted, "|") + `)`
+		r.pairs = regexp.MustCompile(`(?i)\b(` + key + `=)[^&\s"']+`)
+		r.members = regexp.MustCompile(`(?i)("` + key + `"\s*:\s*")(?:[^"\\]|\\.)*`)
+	}
+
+	return r
+}
+
+// Returns a new Redactor for the default keys and patterns plus the given ones.
+func NewDefaultRedactor(keys []string, patterns []*regexp.Regexp) *Redactor {
+	return NewRedactor(
+		append(append([]string{}, DefaultRedactedKeys...), keys...),
+		append(append([]*regexp.Regexp{}, DefaultRedactedPatterns...), patterns...),
+	)
+}
+
+// Reports whether the value of a property with the given key is redacted.
+func (r *Redactor) isRedactedKey(key string) bool {
+	key = strings.ToLower(key)
+
+	if r.keys[key] {
+		return true
+	}
+
+	for i, c := range key {
+		if c == '_' || c == '-' || c == '.' {
+			if r.keys[key[i+1:]] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Redacts the key-value pairs and patterns from the text.
+func (r *Redactor) String(s string) string {
+	if r.pairs != nil {
+		s = r.pairs.ReplaceAllString(s, "${1}"+redacted)
+		s = r.members.ReplaceAllString(s, "${1}"+redacted)
+	}
+
+	for _, pattern := range r.patterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+
+	return s
+}
+
+// Returns a copy of the properties with the sensitive values redacted.
+func (r *Redactor) Properties(properties map[string]any) map[string]any {
+	if properties == nil {
+		return nil
+	}
+
+	result := make(map[string]any, len(properties))
+
+	for key, value := range properties {
+		if r.isRedactedKey(key) {
+			result[key] = redacted
+			continue
+		}
+
+		result[key] = r.value(value)
+	}
+
+	return result
+}
+
+func (r *Redactor) value(value any) any {
+	switch v := value.(type) {
+	case string:
+		return r.String(v)
+	case []byte:
+		return r.String(string(v))
+	case map[string]any:
+		return r.Properties(v)
+	case map[string]string:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[key] = value
+		}
+		return r.Properties(m)
+	case []string:
+		result := make([]string, len(v))
+		for i, s := range v {
+			result[i] = r.String(s)
+		}
+		return result
+	case []any:
+		result := make([]any, len(v))
+		for i, e := range v {
+			result[i] = r.value(e)
+		}
+		return result
+	default:
+		return value
+	}
+}
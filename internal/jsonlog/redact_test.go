@@ -0,0 +1,209 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// A token as generated by data.generateToken(): 26 characters of base32.
+const testToken = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+
+func TestRedactorKeys(t *testing.T) {
+	r := NewDefaultRedactor([]string{"ssn"}, nil)
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"password", true},
+		{"Password", true},
+		{"AUTHORIZATION", true},
+		{"activation_token", true},
+		{"x-apikey", true},
+		{"smtp.secret", true},
+		{"set-cookie", true},
+		{"user_ssn", true},
+		{"ssn", true},
+		{"tokens", false},
+		{"token_count", false},
+		{"passwordless", false},
+		{"request_url", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := r.isRedactedKey(tt.key); got != tt.want {
+				t.Errorf("isRedactedKey(%q) = %t; want %t", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactorString(t *testing.T) {
+	r := NewDefaultRedactor(nil, []*regexp.Regexp{regexp.MustCompile(`\bcard-\d{4}\b`)})
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "Email address",
+			in:   "no user with email alice@example.com",
+			want: "no user with email [REDACTED]",
+		},
+		{
+			name: "Email address with plus and subdomain",
+			in:   "sent to alice.smith+news@mail.example.co.uk.",
+			want: "sent to [REDACTED].",
+		},
+		{
+			name: "Token",
+			in:   "token " + testToken + " has expired",
+			want: "token [REDACTED] has expired",
+		},
+		{
+			name: "Too short for a token",
+			in:   "code Y3QMGX3PJ3WLRL2YRTQGQ6KRH",
+			want: "code Y3QMGX3PJ3WLRL2YRTQGQ6KRH",
+		},
+		{
+			name: "Too long for a token",
+			in:   "code Y3QMGX3PJ3WLRL2YRTQGQ6KRHUA",
+			want: "code Y3QMGX3PJ3WLRL2YRTQGQ6KRHUA",
+		},
+		{
+			name: "Lower case is not a token",
+			in:   "y3qmgx3pj3wlrl2yrtqgq6krhu",
+			want: "y3qmgx3pj3wlrl2yrtqgq6krhu",
+		},
+		{
+			name: "Query string pair",
+			in:   "/v1/users/activated?token=abc123&page=2",
+			want: "/v1/users/activated?token=[REDACTED]&page=2",
+		},
+		{
+			name: "Query string pair with prefixed key",
+			in:   "/callback?refresh_token=abc&state=xyz",
+			want: "/callback?refresh_token=[REDACTED]&state=xyz",
+		},
+		{
+			name: "JSON member",
+			in:   `{"email": "x", "password": "pa\"ss word"}`,
+			want: `{"email": "x", "password": "[REDACTED]"}`,
+		},
+		{
+			name: "Extra pattern",
+			in:   "paid with card-1234",
+			want: "paid with [REDACTED]",
+		},
+		{
+			name: "Nothing to redact",
+			in:   "GET /v1/movies?page=2&sort=-year",
+			want: "GET /v1/movies?page=2&sort=-year",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.String(tt.in); got != tt.want {
+				t.Errorf("String(%q) = %q; want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactorProperties(t *testing.T) {
+	r := NewDefaultRedactor(nil, nil)
+
+	properties := map[string]any{
+		"password":  "pa55word",
+		"user_id":   int64(42),
+		"recipient": "alice@example.com",
+		"headers":   map[string]string{"Authorization": "Bearer " + testToken, "Accept": "*/*"},
+		"args":      []string{"--token=" + testToken, "-v"},
+		"nested":    []any{map[string]any{"cookie": "id=1"}},
+	}
+
+	got := r.Properties(properties)
+
+	want := map[string]any{
+		"password":  redacted,
+		"user_id":   int64(42),
+		"recipient": redacted,
+		"headers":   map[string]any{"Authorization": redacted, "Accept": "*/*"},
+		"args":      []string{"--token=" + redacted, "-v"},
+		"nested":    []any{map[string]any{"cookie": redacted}},
+	}
+
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("got %s; want %s", gotJSON, wantJSON)
+	}
+
+	// The properties passed in must not be changed.
+	if properties["password"] != "pa55word" {
+		t.Errorf("the original properties were modified")
+	}
+}
+
+func TestLoggerRedacts(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := NewWithSinks(LevelInfo, Sink{Writer: &buf, MinLevel: LevelDebug})
+	logger.SetStackTraces(StackTracesOff)
+	logger.SetRedactor(NewDefaultRedactor(nil, nil))
+
+	// The entry written by logError() in cmd/api for a request to the activation
+	// endpoint, with the token in the query string.
+	logger.With(map[string]any{"request_id": "abc"}).PrintError(
+		errors.New("activating alice@example.com"),
+		map[string]any{
+			"request_method": "PUT",
+			"request_url":    "/v1/users/activated?token=" + testToken,
+		},
+	)
+
+	var entry struct {
+		Level      string         `json:"level"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties"`
+	}
+
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), testToken) || strings.Contains(buf.String(), "alice@") {
+		t.Errorf("the log entry was not redacted: %s", buf.String())
+	}
+
+	if entry.Message != "activating [REDACTED]" {
+		t.Errorf("got message %q; want %q", entry.Message, "activating [REDACTED]")
+	}
+
+	wantURL := "/v1/users/activated?token=[REDACTED]"
+	if entry.Properties["request_url"] != wantURL {
+		t.Errorf("got request_url %q; want %q", entry.Properties["request_url"], wantURL)
+	}
+	if entry.Properties["request_id"] != "abc" {
+		t.Errorf("got request_id %q; want %q", entry.Properties["request_id"], "abc")
+	}
+
+	// Without a redactor, the entry is written as it is.
+	buf.Reset()
+	logger.SetRedactor(nil)
+
+	logger.PrintInfo("token "+testToken, nil)
+
+	if !strings.Contains(buf.String(), testToken) {
+		t.Errorf("the log entry was redacted without a redactor: %s", buf.String())
+	}
+}
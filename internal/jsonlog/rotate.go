@@ -0,0 +1,238 @@
+package jsonlog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The format of the time which is added to the names of the rotated files. It sorts in
+// time order and contains no characters which are awkward in file names.
+const rotatedTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is a log sink which writes to a file, and rotates it (renames it with
+// the current time added to its name, and starts a new one) once it reaches a maximum
+// size or has been written to for a maximum time. Only a number of rotated files are
+// kept, and those older than the retention period are removed.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	retention  time.Duration
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	startedAt time.Time
+	closed    bool
+}
+
+// Opens (or creates) the log file at the path. The file is rotated once it would grow
+// beyond maxSize bytes, or when it was started more than maxAge ago; a zero value
+// disables either limit. At most maxBackups rotated files are kept, none of them older
+// than the retention period; again, zero means no limit.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, retention time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		retention:  retention,
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.startedAt = time.Now()
+
+	// A file which already has entries in it was started before we opened it. So that
+	// restarting the application doesn't put off its rotation, its age is measured from
+	// its last entry (as its creation time isn't available on every platform).
+	if f.size > 0 {
+		f.startedAt = info.ModTime()
+	}
+
+	return nil
+}
+
+// Writes the log entry to the file, rotating it first if necessary. Entries are never
+// split between files.
+//
+// A failed rotation doesn't stop the logging: if the file couldn't be renamed, the
+// entry is still written to it (and the rotation is tried again with the next entry),
+// and if the new file couldn't be opened, opening it is tried again with the next
+// entry. Either way the error is returned.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && time.Since(f.startedAt) >= f.maxAge
+
+	var rotateErr error
+
+	if tooBig || tooOld {
+		rotateErr = f.rotate()
+		if f.file == nil {
+			return 0, rotateErr
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	if err == nil {
+		err = rotateErr
+	}
+
+	return n, err
+}
+
+// Renames the current file, opens a new one and removes the rotated files which are
+// no longer kept. If the file can't be renamed, it is reopened so that the entries
+// keep going to it. If the new file can't be opened, f.file is left nil.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return errors.Join(err, f.open())
+	}
+
+	// If the file is rotated more than once in the same millisecond, move the time on
+	// so that the earlier rotated file isn't overwritten.
+	ext := filepath.Ext(f.path)
+	now := time.Now().UTC()
+
+	var rotated string
+	for {
+		rotated = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), now.Format(rotatedTimeFormat), ext)
+
+		_, err := os.Stat(rotated)
+		if os.IsNotExist(err) {
+			break
+		}
+
+		now = now.Add(time.Millisecond)
+	}
+
+	err = os.Rename(f.path, rotated)
+	if err != nil {
+		return errors.Join(err, f.open())
+	}
+
+	err = f.open()
+	if err != nil {
+		return err
+	}
+
+	return f.removeOld()
+}
+
+// Removes the rotated files beyond the maximum number of backups, or older than the
+// retention period.
+func (f *RotatingFile) removeOld() error {
+	if f.maxBackups <= 0 && f.retention <= 0 {
+		return nil
+	}
+
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return err
+	}
+
+	type backup struct {
+		path string
+		time time.Time
+	}
+
+	var backups []backup
+
+	for _, match := range matches {
+		t, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(strings.TrimPrefix(match, prefix), ext))
+		if err != nil {
+			// Not one of our rotated files.
+			continue
+		}
+		backups = append(backups, backup{match, t})
+	}
+
+	// Newest first.
+	slices.SortFunc(backups, func(a, b backup) int {
+		return b.time.Compare(a.time)
+	})
+
+	for i, b := range backups {
+		tooMany := f.maxBackups > 0 && i >= f.maxBackups
+		tooOld := f.retention > 0 && time.Since(b.time) > f.retention
+
+		if tooMany || tooOld {
+			err := os.Remove(b.path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Closes the file. Any later writes fail.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
@@ -0,0 +1,356 @@
+package jsonlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the rotated files next to the log file at path, oldest first.
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(strings.TrimSuffix(path, ".log") + "-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(matches)
+	return matches
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestRotatingFileMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "app.log")
+
+	f, err := NewRotatingFile(path, 100, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var want strings.Builder
+
+	for i := range 10 {
+		entry := fmt.Sprintf("entry %02d: %s\n", i, strings.Repeat("x", 20))
+		want.WriteString(entry)
+
+		_, err := f.Write([]byte(entry))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each entry is 31 bytes, so three of them fit in a file.
+	files := append(backups(t, path), path)
+	if len(files) != 4 {
+		t.Fatalf("got %d files; want 4", len(files))
+	}
+
+	var got strings.Builder
+
+	for _, file := range files {
+		content := readFile(t, file)
+		if len(content) > 100 {
+			t.Errorf("%s is %d bytes; want at most 100", filepath.Base(file), len(content))
+		}
+		got.WriteString(content)
+	}
+
+	// No entry is lost, split or written out of order.
+	if got.String() != want.String() {
+		t.Errorf("got entries:\n%s\nwant:\n%s", got.String(), want.String())
+	}
+}
+
+func TestRotatingFileEntryLargerThanMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	f, err := NewRotatingFile(path, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// An entry which is bigger than maxSize on its own still goes into a file of its
+	// own, rather than being split or rotated out as an empty file.
+	entry := strings.Repeat("x", 50) + "\n"
+
+	for range 2 {
+		_, err := f.Write([]byte(entry))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := backups(t, path); len(got) != 1 {
+		t.Fatalf("got %d backups; want 1", len(got))
+	}
+	if got := readFile(t, path); got != entry {
+		t.Errorf("got %q in the log file; want %q", got, entry)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir := t.TempDir()
+
+	// A log file last written to two hours ago is rotated on the first write after
+	// opening it, even though it has only just been opened.
+	old := filepath.Join(dir, "old.log")
+
+	err := os.WriteFile(old, []byte("old entry\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+
+	err = os.Chtimes(old, twoHoursAgo, twoHoursAgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewRotatingFile(old, 0, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("new entry\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := backups(t, old)
+	if len(rotated) != 1 {
+		t.Fatalf("got %d backups; want 1", len(rotated))
+	}
+	if got := readFile(t, rotated[0]); got != "old entry\n" {
+		t.Errorf("got %q in the backup; want %q", got, "old entry\n")
+	}
+	if got := readFile(t, old); got != "new entry\n" {
+		t.Errorf("got %q in the log file; want %q", got, "new entry\n")
+	}
+
+	// A recently written log file is appended to.
+	recent := filepath.Join(dir, "recent.log")
+
+	err = os.WriteFile(recent, []byte("recent entry\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewRotatingFile(recent, 0, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	_, err = g.Write([]byte("new entry\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := backups(t, recent); len(got) != 0 {
+		t.Errorf("got %d backups; want 0", len(got))
+	}
+	if got := readFile(t, recent); got != "recent entry\nnew entry\n" {
+		t.Errorf("got %q in the log file; want both entries", got)
+	}
+}
+
+func TestRotatingFileRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+
+	f, err := NewRotatingFile(path, 20, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entry := func(i int) string {
+		return fmt.Sprintf("entry %02d: xxxxx\n", i)
+	}
+
+	_, err = f.Write([]byte(entry(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The log file is removed behind our back, so it can't be renamed when it's time to
+	// rotate it. The error is returned, but the entry still goes to the log file, which
+	// is created again.
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := f.Write([]byte(entry(2)))
+	if err == nil {
+		t.Fatal("got no error when the log file couldn't be rotated")
+	}
+	if n != len(entry(2)) {
+		t.Errorf("wrote %d bytes; want %d", n, len(entry(2)))
+	}
+	if got := readFile(t, path); got != entry(2) {
+		t.Errorf("got %q in the log file; want %q", got, entry(2))
+	}
+
+	// The next rotation works.
+	_, err = f.Write([]byte(entry(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := backups(t, path)
+	if len(rotated) != 1 {
+		t.Fatalf("got %d backups; want 1", len(rotated))
+	}
+	if got := readFile(t, rotated[0]); got != entry(2) {
+		t.Errorf("got %q in the backup; want %q", got, entry(2))
+	}
+	if got := readFile(t, path); got != entry(3) {
+		t.Errorf("got %q in the log file; want %q", got, entry(3))
+	}
+
+	// If the new file couldn't be opened after a rotation, the next write opens it.
+	f.file.Close()
+	f.file = nil
+
+	_, err = f.Write([]byte(entry(4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backups(t, path); len(got) != 2 {
+		t.Errorf("got %d backups; want 2", len(got))
+	}
+	if got := readFile(t, path); got != entry(4) {
+		t.Errorf("got %q in the log file; want %q", got, entry(4))
+	}
+}
+
+func TestRotatingFileRemoveOld(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		retention  time.Duration
+		want       []string
+	}{
+		{
+			name:       "No limits",
+			maxBackups: 0,
+			retention:  0,
+			want:       []string{"40d", "20d", "1d", "now"},
+		},
+		{
+			name:       "Max backups",
+			maxBackups: 2,
+			retention:  0,
+			want:       []string{"1d", "now"},
+		},
+		{
+			name:       "Retention",
+			maxBackups: 0,
+			retention:  30 * 24 * time.Hour,
+			want:       []string{"20d", "1d", "now"},
+		},
+		{
+			name:       "Both",
+			maxBackups: 3,
+			retention:  7 * 24 * time.Hour,
+			want:       []string{"1d", "now"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+
+			// Create rotated files from some time ago, labelled with their age, and a file
+			// which only looks like one.
+			ages := map[string]time.Duration{
+				"40d": 40 * 24 * time.Hour,
+				"20d": 20 * 24 * time.Hour,
+				"1d":  24 * time.Hour,
+			}
+
+			for label, age := range ages {
+				name := "app-" + time.Now().UTC().Add(-age).Format(rotatedTimeFormat) + ".log"
+
+				err := os.WriteFile(filepath.Join(dir, name), []byte(label), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			other := filepath.Join(dir, "app-notes.log")
+
+			err := os.WriteFile(other, []byte("notes"), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := NewRotatingFile(path, 5, 0, tt.maxBackups, tt.retention)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			// The second write rotates the first one out, as "now".
+			for _, entry := range []string{"now", "next"} {
+				_, err := f.Write([]byte(entry))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+
+			for _, backup := range backups(t, path) {
+				if backup != other {
+					got = append(got, readFile(t, backup))
+				}
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got backups %q; want %q", got, tt.want)
+			}
+
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("a file which isn't a backup was removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotatingFileClose(t *testing.T) {
+	f, err := NewRotatingFile(filepath.Join(t.TempDir(), "app.log"), 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write([]byte("entry\n"))
+	if err != os.ErrClosed {
+		t.Errorf("got error %v after closing; want %v", err, os.ErrClosed)
+	}
+}
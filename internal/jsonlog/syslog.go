@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+
+package jsonlog
+
+import (
+	"log/syslog"
+)
+
+// Syslog is a log sink which sends the entries to the local syslog daemon (through its
+// Unix socket), with the syslog severity matching the level of each entry.
+type Syslog struct {
+	w *syslog.Writer
+}
+
+// Connects to the local syslog daemon. The entries are sent with the given tag (e.g.
+// the program name) and the "daemon" facility.
+func NewSyslog(tag string) (*Syslog, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Syslog{w: w}, nil
+}
+
+// Implements the io.Writer interface, sending the entry with the INFO severity.
+func (s *Syslog) Write(p []byte) (int, error) {
+	return s.WriteLevel(LevelInfo, p)
+}
+
+// Implements the LevelWriter interface.
+func (s *Syslog) WriteLevel(level Level, p []byte) (int, error) {
+	// The syslog package adds its own newline.
+	msg := string(p)
+
+	var err error
+
+	switch level {
+	case LevelDebug:
+		err = s.w.Debug(msg)
+	case LevelInfo:
+		err = s.w.Info(msg)
+	case LevelWarn:
+		err = s.w.Warning(msg)
+	case LevelError:
+		err = s.w.Err(msg)
+	default:
+		err = s.w.Crit(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Closes the connection to the syslog daemon.
+func (s *Syslog) Close() error {
+	return s.w.Close()
+}
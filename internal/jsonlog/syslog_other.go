@@ -0,0 +1,19 @@
+//go:build windows || plan9
+
+package jsonlog
+
+import (
+	"errors"
+)
+
+// Syslog is not supported on this platform.
+type Syslog struct{}
+
+// Always returns an error, as there is no syslog daemon on this platform.
+func NewSyslog(tag string) (*Syslog, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (s *Syslog) Write(p []byte) (int, error)                   { return 0, errors.ErrUnsupported }
+func (s *Syslog) WriteLevel(level Level, p []byte) (int, error) { return 0, errors.ErrUnsupported }
+func (s *Syslog) Close() error                                  { return nil }
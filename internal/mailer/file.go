@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"os"
+	"time"
+)
+
+// A FileMailer writes each email to a .eml file in a directory instead of sending it,
+// so that the emails can be opened in an email client or read by integration tests.
+type FileMailer struct {
+	dir    string
+	sender string
+}
+
+// A NewFile() constructor function which returns a new FileMailer instance. The
+// directory is created if it doesn't exist yet.
+func NewFile(dir, sender string) (*FileMailer, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileMailer{
+		dir:    dir,
+		sender: sender,
+	}, nil
+}
+
+// Renders the email and writes it to a new file in the directory. The file names start
+// with the time the email was written, so that they sort in the order the emails were
+// sent, followed by a random suffix to keep them unique.
+func (m *FileMailer) Send(recipient, locale, templateFile string, data any) error {
+	msg, err := render(recipient, m.sender, locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(m.dir, time.Now().UTC().Format("20060102T150405.000000000")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.mime().WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,206 @@
+package mailer
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// The locale of the default templates at the top level of the templates directory.
+// Templates for other locales live in a templates/<locale> subdirectory.
+const DefaultLocale = "en"
+
+// Returns the locales which we have email templates for, starting with the default.
+func Locales() []string {
+	locales := []string{DefaultLocale}
+
+	entries, _ := fs.ReadDir(templateFS, "templates")
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != DefaultLocale {
+			locales = append(locales, entry.Name())
+		}
+	}
+
+	return locales
+}
+
+// Returns the path of the template file to use for the locale. We look for the
+// template in the directory for the exact locale (e.g. templates/pt-BR), then in the
+// directory for its language (templates/pt), and finally fall back to the default
+// template.
+func templatePath(locale, templateFile string) string {
+	candidates := []string{locale}
+	if language, _, found := strings.Cut(locale, "-"); found {
+		candidates = append(candidates, language)
+	}
+
+	for _, candidate := range candidates {
+		if candidate == "" || candidate == DefaultLocale {
+			continue
+		}
+
+		path := "templates/" + candidate + "/" + templateFile
+		if _, err := fs.Stat(templateFS, path); err == nil {
+			return path
+		}
+	}
+
+	return "templates/" + templateFile
+}
+
+// The names of the months and the time units in a language, and the rules for
+// putting them together.
+type localeFormat struct {
+	months [12]string
+	date   func(f *localeFormat, t time.Time) string
+	// The singular and plural forms of each unit. Russian needs two plural forms,
+	// one for numbers ending in 2-4 and one for the rest.
+	units  map[string][3]string
+	plural func(n int) int
+}
+
+var localeFormats = map[string]*localeFormat{
+	"en": {
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		date: func(f *localeFormat, t time.Time) string {
+			return fmt.Sprintf("%s %d, %d at %s", f.months[t.Month()-1], t.Day(), t.Year(), t.Format("15:04 MST"))
+		},
+		units: map[string][3]string{
+			"day":    {"day", "days", "days"},
+			"hour":   {"hour", "hours", "hours"},
+			"minute": {"minute", "minutes", "minutes"},
+		},
+		plural: func(n int) int {
+			if n == 1 {
+				return 0
+			}
+			return 1
+		},
+	},
+	"ru": {
+		months: [12]string{"января", "февраля", "марта", "апреля", "мая", "июня", "июля", "августа", "сентября", "октября", "ноября", "декабря"},
+		date: func(f *localeFormat, t time.Time) string {
+			return fmt.Sprintf("%d %s %d г., %s", t.Day(), f.months[t.Month()-1], t.Year(), t.Format("15:04 MST"))
+		},
+		units: map[string][3]string{
+			"day":    {"день", "дня", "дней"},
+			"hour":   {"час", "часа", "часов"},
+			"minute": {"минуту", "минуты", "минут"},
+		},
+		plural: func(n int) int {
+			switch {
+			case n%10 == 1 && n%100 != 11:
+				return 0
+			case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+				return 1
+			default:
+				return 2
+			}
+		},
+	},
+}
+
+// Returns the formatting rules for the locale, falling back to its language and then
+// to the default locale.
+func formatFor(locale string) *localeFormat {
+	if f, ok := localeFormats[locale]; ok {
+		return f
+	}
+
+	language, _, _ := strings.Cut(locale, "-")
+	if f, ok := localeFormats[language]; ok {
+		return f
+	}
+
+	return localeFormats[DefaultLocale]
+}
+
+// Returns the functions available in the templates for formatting values for the
+// locale:
+//
+//	{{date .activationTokenExpiry}}     -> "January 2, 2006 at 15:04 UTC"
+//	{{duration .activationTokenTTL}}    -> "3 days"
+//
+// The template data is stored as JSON in the email outbox, so as well as time.Time and
+// time.Duration values, these also accept times as RFC 3339 strings and durations in
+// the format used by time.ParseDuration().
+func templateFuncs(locale string) template.FuncMap {
+	f := formatFor(locale)
+
+	return template.FuncMap{
+		"date": func(value any) (string, error) {
+			t, err := toTime(value)
+			if err != nil {
+				return "", err
+			}
+			return f.date(f, t.UTC()), nil
+		},
+		"duration": func(value any) (string, error) {
+			d, err := toDuration(value)
+			if err != nil {
+				return "", err
+			}
+			return f.duration(d), nil
+		},
+	}
+}
+
+// Formats the duration in the largest whole unit which fits it (days, hours or
+// minutes), e.g. "3 days" rather than "72 hours".
+func (f *localeFormat) duration(d time.Duration) string {
+	unit, n := "minute", int(d/time.Minute)
+
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		unit, n = "day", int(d/(24*time.Hour))
+	case d >= time.Hour && d%time.Hour == 0:
+		unit, n = "hour", int(d/time.Hour)
+	}
+
+	return fmt.Sprintf("%d %s", n, f.units[unit][f.plural(n)])
+}
+
+func toTime(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339, v)
+	default:
+		return time.Time{}, fmt.Errorf("cannot format %T as a date", value)
+	}
+}
+
+func toDuration(value any) (time.Duration, error) {
+	switch v := value.(type) {
+	case time.Duration:
+		return v, nil
+	case string:
+		return time.ParseDuration(v)
+	default:
+		return 0, fmt.Errorf("cannot format %T as a duration", value)
+	}
+}
+
+// Returns the locale in the list which best matches the locale, by language if there
+// is no exact match, or an empty string if there is none.
+// Locale tags are compared case-insensitively, so "en-us" matches "en-US".
+func Match(locale string, locales []string) string {
+	for _, l := range locales {
+		if strings.EqualFold(l, locale) {
+			return l
+		}
+	}
+
+	language, _, _ := strings.Cut(locale, "-")
+	for _, l := range locales {
+		lang, _, _ := strings.Cut(l, "-")
+		if strings.EqualFold(lang, language) {
+			return l
+		}
+	}
+
+	return ""
+}
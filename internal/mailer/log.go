@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+)
+
+// A LogMailer writes each email to the application log instead of sending it. Only the
+// plain-text body is logged, which contains the same information as the HTML one.
+type LogMailer struct {
+	logger *jsonlog.Logger
+	sender string
+}
+
+// A NewLog() constructor function which returns a new LogMailer instance.
+func NewLog(logger *jsonlog.Logger, sender string) *LogMailer {
+	return &LogMailer{
+		logger: logger,
+		sender: sender,
+	}
+}
+
+// Renders the email and writes it to the log as an INFO entry.
+func (m *LogMailer) Send(recipient, locale, templateFile string, data any) error {
+	msg, err := render(recipient, m.sender, locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.logger.PrintInfo("email sent", map[string]any{
+		"to":       msg.recipient,
+		"from":     msg.sender,
+		"subject":  msg.subject,
+		"template": templateFile,
+		"locale":   locale,
+		"body":     msg.plainBody,
+	})
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.mazavrbazavr.ru/internal/jsonlog"
+)
+
+func TestLogMailerRedaction(t *testing.T) {
+	const token = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+
+	data := map[string]any{
+		"activationToken":       token,
+		"activationTokenExpiry": time.Date(2026, 10, 21, 9, 30, 0, 0, time.UTC),
+		"activationTokenTTL":    (72 * time.Hour).String(),
+		"userID":                int64(42),
+	}
+
+	tests := []struct {
+		name      string
+		redactor  *jsonlog.Redactor
+		wantToken bool
+	}{
+		{name: "Redacted", redactor: jsonlog.NewDefaultRedactor(nil, nil), wantToken: false},
+		{name: "Not redacted", redactor: nil, wantToken: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			logger := jsonlog.New(&buf, jsonlog.LevelInfo)
+			logger.SetRedactor(tt.redactor)
+
+			m := NewLog(logger, "Greenlight <no-reply@greenlight.mazavrbazavr.ru>")
+
+			err := m.Send("alice@example.com", DefaultLocale, "user_welcome.tmpl", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var entry struct {
+				Message    string            `json:"message"`
+				Properties map[string]string `json:"properties"`
+			}
+
+			err = json.Unmarshal(buf.Bytes(), &entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.Message != "email sent" {
+				t.Errorf("got message %q; want %q", entry.Message, "email sent")
+			}
+			if entry.Properties["subject"] != "Welcome to Greenlight!" {
+				t.Errorf("got subject %q; want %q", entry.Properties["subject"], "Welcome to Greenlight!")
+			}
+
+			body := entry.Properties["body"]
+
+			if got := strings.Contains(body, token); got != tt.wantToken {
+				t.Errorf("token in body = %t; want %t\nbody: %s", got, tt.wantToken, body)
+			}
+			if got := strings.Contains(buf.String(), "alice@example.com"); got != tt.wantToken {
+				t.Errorf("recipient in entry = %t; want %t", got, tt.wantToken)
+			}
+			if !tt.wantToken && !strings.Contains(body, `{"token": "[REDACTED]"}`) {
+				t.Errorf("body does not contain the redacted token: %s", body)
+			}
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
-	"time"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -18,37 +17,39 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// A Mailer struct which contains a mail.Dialer instance (used to connect to a
-// SMTP server) and the sender information for your emails (the name and address you
-// want the email to be from, such as "Alice Smith <alice@example.com>").
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// The Mailer interface is implemented by each of the ways we have of delivering email:
+// the SMTP mailer used in production, and the file and log mailers which let us see
+// the emails (and the activation tokens in them) during development and testing
+// without an SMTP server. The Send() method takes the recipient email address as the
+// first parameter, the recipient's locale (which selects the translation of the
+// templates), the name of the file containing the templates, and any dynamic data for
+// the templates as an any parameter.
+type Mailer interface {
+	Send(recipient, locale, templateFile string, data any) error
 }
 
-// A New() constructor function which returns a new Mailer instance.
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
-	// also configure this to use a 5-second timeout whenever we send an email.
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-
-	// Return a Mailer instance containing the dialer and sender information.
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
-	}
+// A message struct to hold the rendered parts of an email.
+type message struct {
+	recipient string
+	sender    string
+	subject   string
+	plainBody string
+	htmlBody  string
 }
 
-// A Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// Renders the "subject", "plainBody" and "htmlBody" templates in the given template
+// file for the locale, using the dynamic data.
+func render(recipient, sender, locale, templateFile string, data any) (*message, error) {
 	// Use the ParseFS() method to parse the required template file from the embedded
-	// file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	// file system. The functions for formatting dates and durations for the locale are
+	// registered before parsing, as the templates can't be parsed without them. A key
+	// missing from the data is an error, rather than being rendered as "<no value>".
+	tmpl, err := template.New("email").
+		Funcs(templateFuncs(locale)).
+		Option("missingkey=error").
+		ParseFS(templateFS, templatePath(locale, templateFile))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Execute the named template "subject", passing in the dynamic data and storing the
@@ -56,7 +57,7 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Follow the same pattern to execute the "plainBody" template and store the result
@@ -64,44 +65,38 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// And likewise with the "htmlBody" template.
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return &message{
+		recipient: recipient,
+		sender:    sender,
+		subject:   subject.String(),
+		plainBody: plainBody.String(),
+		htmlBody:  htmlBody.String(),
+	}, nil
+}
+
+// Builds a MIME message from the rendered email.
+func (msg *message) mime() *mail.Message {
 	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
 	// Then we use the SetHeader() method to set the email recipient, sender and subject
 	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
 	// method to set the HTML body. It's important to note that AddAlternative() should
 	// always be called *after* SetBody().
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	// Call the DialAndSend() method on the dialer, passing in the message to send. This
-	// opens a connection to the SMTP server, sends the message, then closes the
-	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
-	// error.
-	// Try sending the email up to three times before aborting and returning the final
-	// error. We sleep for 500 milliseconds between each attempt.
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		// If everything worked, return nil.
-		if nil == err {
-			return nil
-		}
-
-		// If it didn't work, sleep for a short time and retry.
-		time.Sleep(500 * time.Millisecond)
-	}
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.recipient)
+	m.SetHeader("From", msg.sender)
+	m.SetHeader("Subject", msg.subject)
+	m.SetBody("text/plain", msg.plainBody)
+	m.AddAlternative("text/html", msg.htmlBody)
 
-	return err
+	return m
 }
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Returned by Render() when there is no template file with the given name.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// Template struct describing one of the email templates in templateFS, and the locales
+// it has been translated into.
+type Template struct {
+	Name    string   `json:"name"`
+	Locales []string `json:"locales"`
+}
+
+// Returns all the email templates, sorted by name. The default templates define which
+// templates exist; translations of templates which don't exist in the default locale
+// are ignored, as Send() would never use them.
+func Templates() ([]Template, error) {
+	names, err := fs.Glob(templateFS, "templates/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := []Template{}
+
+	for _, name := range names {
+		t := Template{
+			Name:    path.Base(name),
+			Locales: []string{DefaultLocale},
+		}
+
+		for _, locale := range Locales()[1:] {
+			if _, err := fs.Stat(templateFS, "templates/"+locale+"/"+t.Name); err == nil {
+				t.Locales = append(t.Locales, locale)
+			}
+		}
+
+		templates = append(templates, t)
+	}
+
+	slices.SortFunc(templates, func(a, b Template) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return templates, nil
+}
+
+// Preview struct to hold the rendered parts of an email.
+type Preview struct {
+	Subject   string `json:"subject"`
+	PlainBody string `json:"plain_body"`
+	HTMLBody  string `json:"html_body"`
+}
+
+// Renders the template file for the locale with the given data, in exactly the same way
+// as Send() does, but returns the result instead of sending it. Any error from parsing
+// or executing the template (e.g. a missing key in the data) is returned as-is, as the
+// error messages from the template package point to the line and action at fault.
+func Render(locale, templateFile string, data any) (*Preview, error) {
+	if strings.Contains(templateFile, "/") {
+		return nil, ErrTemplateNotFound
+	}
+
+	if _, err := fs.Stat(templateFS, "templates/"+templateFile); err != nil {
+		return nil, ErrTemplateNotFound
+	}
+
+	msg, err := render("", "", locale, templateFile, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Preview{
+		Subject:   msg.subject,
+		PlainBody: msg.plainBody,
+		HTMLBody:  msg.htmlBody,
+	}, nil
+}
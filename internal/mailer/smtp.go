@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// A SMTPMailer struct which contains a mail.Dialer instance (used to connect to a
+// SMTP server) and the sender information for your emails (the name and address you
+// want the email to be from, such as "Alice Smith <alice@example.com>").
+type SMTPMailer struct {
+	dialer *mail.Dialer
+	sender string
+}
+
+// A NewSMTP() constructor function which returns a new SMTPMailer instance.
+func NewSMTP(host string, port int, username, password, sender string) *SMTPMailer {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+	// also configure this to use a 5-second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	// Return a SMTPMailer instance containing the dialer and sender information.
+	return &SMTPMailer{
+		dialer: dialer,
+		sender: sender,
+	}
+}
+
+// Renders the email and sends it through the SMTP server.
+func (m *SMTPMailer) Send(recipient, locale, templateFile string, data any) error {
+	msg, err := render(recipient, m.sender, locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	// Call the DialAndSend() method on the dialer, passing in the message to send. This
+	// opens a connection to the SMTP server, sends the message, then closes the
+	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
+	// error.
+	// Try sending the email up to three times before aborting and returning the final
+	// error. We sleep for 500 milliseconds between each attempt.
+	for i := 1; i <= 3; i++ {
+		err = m.dialer.DialAndSend(msg.mime())
+		// If everything worked, return nil.
+		if nil == err {
+			return nil
+		}
+
+		// If it didn't work, sleep for a short time and retry.
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return err
+}
@@ -0,0 +1,331 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The default histogram buckets, in seconds, which are the same as those of the
+// Prometheus client libraries and suit the latency of HTTP requests.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A collector is anything which can write its metric family to the exposition.
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry holds the metrics which are exposed together on the /metrics endpoint. This
+// package implements the handful of Prometheus metric types which the application
+// needs (counters, gauges and histograms, with or without labels), and writes them in
+// the Prometheus text exposition format, without pulling in the whole Prometheus
+// client library.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// Writes all the metrics in the registry in the text exposition format, in the order
+// in which they were registered.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		err := c.write(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns a http.Handler which serves the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// CounterVec is a counter, partitioned by the values of its labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Registers a new counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterSeries),
+	}
+
+	r.register(c)
+	return c
+}
+
+// Adds the (non-negative) value to the counter with the given label values, which
+// must be given in the same order as the label names.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.values[key]
+	if !ok {
+		s = &counterSeries{labelValues: slices.Clone(labelValues)}
+		c.values[key] = s
+	}
+
+	s.value += value
+}
+
+// Adds one to the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := writeHeader(w, c.name, c.help, "counter")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		s := c.values[key]
+
+		_, err := fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labelValues), formatValue(s.value))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// funcMetric is a counter or gauge without labels whose value is read from a
+// function whenever the metrics are written, e.g. from the sql.DB statistics.
+type funcMetric struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// Registers a gauge whose value is returned by the function.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// Registers a counter whose value is returned by the function. The function must
+// never return a smaller value than it did before.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{name: name, help: help, kind: "counter", fn: fn})
+}
+
+func (m *funcMetric) write(w io.Writer) error {
+	err := writeHeader(w, m.name, m.help, m.kind)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.fn()))
+	return err
+}
+
+// HistogramVec is a histogram, partitioned by the values of its labels.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // The count for each bucket (not cumulative).
+	count       uint64
+	sum         float64
+}
+
+// Registers a new histogram with the given (sorted) bucket upper bounds and label
+// names. The +Inf bucket is added automatically.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramSeries),
+	}
+
+	r.register(h)
+	return h
+}
+
+// Records an observation in the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: slices.Clone(labelValues),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			s.counts[i]++
+			break
+		}
+	}
+
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err := writeHeader(w, h.name, h.help, "histogram")
+	if err != nil {
+		return err
+	}
+
+	labels := append(slices.Clone(h.labels), "le")
+
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+
+		// The buckets in the exposition are cumulative.
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += s.counts[i]
+
+			labelValues := append(slices.Clone(s.labelValues), formatValue(upperBound))
+
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, labelValues), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		labelValues := append(slices.Clone(s.labelValues), "+Inf")
+
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, formatLabels(labels, labelValues), s.count,
+			h.name, formatLabels(h.labels, s.labelValues), formatValue(s.sum),
+			h.name, formatLabels(h.labels, s.labelValues), s.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeHeader(w io.Writer, name, help, kind string) error {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	return err
+}
+
+// Formats the labels as {name="value",...}, escaping the values as required by the
+// exposition format, or returns an empty string if there are no labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var b strings.Builder
+
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escape.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Label values are joined with a byte which can't appear in valid UTF-8 to make the
+// key for a series.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,563 @@
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// The key of the PostgreSQL advisory lock which is held while migrating, so that when
+// several instances are deployed at once only one of them migrates the database; the
+// others wait, and then find nothing left to do.
+const lockKey int64 = 7_265_616_378_119_524_401
+
+// The migration files are named "<version>_<name>.up.sql" and "<version>_<name>.down.sql",
+// as for the migrate CLI (e.g. "000001_create_movies_table.up.sql").
+var fileRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+var (
+	// ErrDirty is returned when a migration run by the migrate CLI failed partway
+	// through, leaving the schema in an unknown state which has to be fixed by hand.
+	ErrDirty = errors.New("database schema is dirty")
+	// ErrChecksum is returned when an applied migration has been changed since it was
+	// applied, so the schema may not be what the migrations say it is.
+	ErrChecksum = errors.New("applied migration has been modified")
+	// ErrBehind is returned by Check() when there are migrations which haven't been
+	// applied.
+	ErrBehind = errors.New("database schema is behind")
+)
+
+// Migration holds a migration loaded from the migration files. The checksum is the
+// SHA-256 of the up migration, which is recorded when it is applied.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Loads the migrations from the files in the root of the file system, sorted by
+// version. Every migration must have an up file; the down file is optional.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		matches := fileRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid version: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(".", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		} else if m.Name != matches[2] {
+			return nil, fmt.Errorf("%s: version %d is also used by %q", entry.Name(), version, m.Name)
+		}
+
+		switch matches[3] {
+		case "up":
+			sum := sha256.Sum256(content)
+			m.Up, m.Checksum = string(content), hex.EncodeToString(sum[:])
+		case "down":
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+		if m.Checksum == "" {
+			return nil, fmt.Errorf("migration %d (%s) has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return migrations, nil
+}
+
+// Status holds the state of a migration for the "status" command. The State is one of
+// "applied", "pending", "modified" (applied, but changed since) or "unknown" (applied,
+// but not among the migration files, e.g. by a newer version of the application).
+type Status struct {
+	Version   int64
+	Name      string
+	State     string
+	AppliedAt *time.Time
+}
+
+// Migrator applies the migrations to the database. It records the applied migrations,
+// with their checksums, in the schema_migrations_history table. It also keeps the
+// schema_migrations table used by the migrate CLI up to date, so that the two can be
+// used on the same database, and adopts the migrations already applied by the CLI.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// Returns a new Migrator for the migrations in the file system.
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Returns the version of the latest migration, or 0 if there are none.
+func (m *Migrator) Latest() int64 {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	i, found := slices.BinarySearchFunc(m.Migrations, version, func(mig Migration, v int64) int {
+		return cmp.Compare(mig.Version, v)
+	})
+	if !found {
+		return Migration{}, false
+	}
+	return m.Migrations[i], true
+}
+
+// An applied migration, as recorded in the history.
+type applied struct {
+	name      string
+	checksum  string
+	appliedAt *time.Time
+}
+
+// The state of the database: the version in the schema_migrations table, whether it
+// is dirty, and the applied migrations by version. Reverted holds the versions in the
+// history which are above the schema version, because the migrate CLI reverted them.
+type state struct {
+	version  int64
+	dirty    bool
+	applied  map[int64]applied
+	reverted []int64
+}
+
+// The subset of *sql.DB, *sql.Conn and *sql.Tx that reading the state needs.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Reads the state of the database. The migrate CLI only records the current version
+// in schema_migrations, not a history, and it is still used alongside this package
+// (e.g. by "make db/migrations/up"). So every time the state is read, the migrations
+// up to the version in schema_migrations which are missing from the history are taken
+// to have been applied by the CLI as they are now, and the migrations in the history
+// above that version to have been reverted by it.
+func (m *Migrator) readState(ctx context.Context, q queryer) (*state, error) {
+	s := &state{applied: make(map[int64]applied)}
+
+	var exists bool
+
+	err := q.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		err = q.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&s.version, &s.dirty)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	err = q.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations_history') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		rows, err := q.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations_history`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int64
+			var a applied
+			var appliedAt time.Time
+
+			err := rows.Scan(&version, &a.name, &a.checksum, &appliedAt)
+			if err != nil {
+				return nil, err
+			}
+
+			if version > s.version {
+				s.reverted = append(s.reverted, version)
+				continue
+			}
+
+			a.appliedAt = &appliedAt
+			s.applied[version] = a
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, mig := range m.Migrations {
+		if _, ok := s.applied[mig.Version]; !ok && mig.Version <= s.version {
+			s.applied[mig.Version] = applied{name: mig.Name, checksum: mig.Checksum}
+		}
+	}
+
+	return s, nil
+}
+
+// Checks that the database can be migrated: that it isn't dirty and that none of the
+// applied migrations have been modified.
+func (m *Migrator) verify(s *state) error {
+	if s.dirty {
+		return fmt.Errorf("%w at version %d: fix it by hand, then set dirty to false in schema_migrations", ErrDirty, s.version)
+	}
+
+	for version, a := range s.applied {
+		mig, ok := m.find(version)
+		if ok && mig.Checksum != a.checksum {
+			return fmt.Errorf("%w: %d (%s)", ErrChecksum, version, mig.Name)
+		}
+	}
+
+	return nil
+}
+
+// Returns the status of each migration, both those in the migration files and any
+// unknown ones which have been applied, sorted by version.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	s, err := m.readState(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+
+	for _, mig := range m.Migrations {
+		status := Status{Version: mig.Version, Name: mig.Name, State: "pending"}
+
+		if a, ok := s.applied[mig.Version]; ok {
+			status.State, status.AppliedAt = "applied", a.appliedAt
+			if a.checksum != mig.Checksum {
+				status.State = "modified"
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	for version, a := range s.applied {
+		if _, ok := m.find(version); !ok {
+			statuses = append(statuses, Status{Version: version, Name: a.name, State: "unknown", AppliedAt: a.appliedAt})
+		}
+	}
+
+	slices.SortFunc(statuses, func(a, b Status) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return statuses, nil
+}
+
+// Returns the version of the database schema, and an error if the schema is behind
+// the migrations (there are migrations which haven't been applied), is dirty, or has
+// modified migrations applied. The server uses this to refuse to start against a
+// schema it doesn't match. A schema which is ahead of the migrations (e.g. after a
+// newer version of the application has been rolled back) is accepted.
+func (m *Migrator) Check(ctx context.Context) (int64, error) {
+	s, err := m.readState(ctx, m.DB)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.verify(s)
+	if err != nil {
+		return s.version, err
+	}
+
+	var pending []int64
+	for _, mig := range m.Migrations {
+		if _, ok := s.applied[mig.Version]; !ok {
+			pending = append(pending, mig.Version)
+		}
+	}
+
+	if len(pending) > 0 {
+		return s.version, fmt.Errorf("%w: %d migration(s) pending, the first being %d", ErrBehind, len(pending), pending[0])
+	}
+
+	return s.version, nil
+}
+
+// Applies all the pending migrations, in order, and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Reverts the latest n applied migrations, and returns them.
+func (m *Migrator) Down(ctx context.Context, n int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn, s *state) error {
+		versions := appliedVersions(s)
+
+		for i := len(versions) - 1; i >= 0 && len(done) < n; i-- {
+			mig, err := m.revert(ctx, conn, versions[i], versions[:i])
+			if err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Migrates the database up or down to the given version (0 reverts all migrations),
+// and returns the migrations applied or reverted.
+func (m *Migrator) Goto(ctx context.Context, target int64) ([]Migration, error) {
+	if _, ok := m.find(target); !ok && target != 0 {
+		return nil, fmt.Errorf("no migration with version %d", target)
+	}
+
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn, s *state) error {
+		// Revert the migrations after the target, latest first.
+		versions := appliedVersions(s)
+
+		for i := len(versions) - 1; i >= 0 && versions[i] > target; i-- {
+			mig, err := m.revert(ctx, conn, versions[i], versions[:i])
+			if err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+
+		// Then apply the pending migrations up to the target, in order.
+		for _, mig := range m.Migrations {
+			if _, ok := s.applied[mig.Version]; ok || mig.Version > target {
+				continue
+			}
+
+			err := m.apply(ctx, conn, mig, max(mig.Version, s.version))
+			if err != nil {
+				return err
+			}
+
+			s.applied[mig.Version] = applied{name: mig.Name, checksum: mig.Checksum}
+			s.version = max(mig.Version, s.version)
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Returns the versions of the applied migrations, in order.
+func appliedVersions(s *state) []int64 {
+	versions := make([]int64, 0, len(s.applied))
+	for version := range s.applied {
+		versions = append(versions, version)
+	}
+
+	slices.Sort(versions)
+	return versions
+}
+
+// Runs fn on a dedicated connection while holding the advisory lock, with the state
+// of the database, which is read (and verified) once the lock has been acquired. The
+// tables for tracking the migrations are created if necessary, and any migrations
+// applied by the migrate CLI are recorded in the history.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, s *state) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version bigint NOT NULL PRIMARY KEY,
+            dirty boolean NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS schema_migrations_history (
+            version bigint NOT NULL PRIMARY KEY,
+            name text NOT NULL,
+            checksum text NOT NULL,
+            applied_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+        )`)
+	if err != nil {
+		return err
+	}
+
+	s, err := m.readState(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	err = m.verify(s)
+	if err != nil {
+		return err
+	}
+
+	// Bring the history up to date with what the migrate CLI has done since it was last
+	// written: record the migrations it has applied (which have no applied_at time yet)
+	// and forget those it has reverted.
+	for version, a := range s.applied {
+		if a.appliedAt != nil {
+			continue
+		}
+
+		_, err := conn.ExecContext(ctx, `
+            INSERT INTO schema_migrations_history (version, name, checksum)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (version) DO NOTHING`, version, a.name, a.checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.reverted) > 0 {
+		_, err := conn.ExecContext(ctx, `
+            DELETE FROM schema_migrations_history
+            WHERE version > $1`, s.version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fn(conn, s)
+}
+
+// Applies the migration in a transaction, recording it in the history and setting the
+// schema version.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, version int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, mig.Up)
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO schema_migrations_history (version, name, checksum)
+        VALUES ($1, $2, $3)`, mig.Version, mig.Name, mig.Checksum)
+	if err != nil {
+		return err
+	}
+
+	err = setVersion(ctx, tx, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Reverts the applied migration with the given version in a transaction, removing it
+// from the history and setting the schema version to the latest of those remaining.
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, version int64, remaining []int64) (Migration, error) {
+	mig, ok := m.find(version)
+	if !ok {
+		return mig, fmt.Errorf("applied migration %d is unknown, so it can't be reverted", version)
+	}
+	if mig.Down == "" {
+		return mig, fmt.Errorf("migration %d (%s) has no down file", mig.Version, mig.Name)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return mig, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, mig.Down)
+	if err != nil {
+		return mig, fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations_history WHERE version = $1`, mig.Version)
+	if err != nil {
+		return mig, err
+	}
+
+	var previous int64
+	if len(remaining) > 0 {
+		previous = remaining[len(remaining)-1]
+	}
+
+	err = setVersion(ctx, tx, previous)
+	if err != nil {
+		return mig, err
+	}
+
+	return mig, tx.Commit()
+}
+
+// Sets the version in the schema_migrations table, which has a single row (or none,
+// for version 0), as the migrate CLI expects.
+func setVersion(ctx context.Context, tx *sql.Tx, version int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+	return err
+}
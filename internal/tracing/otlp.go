@@ -0,0 +1,292 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The limits on how many spans are queued for export (spans are dropped once the
+// queue is full, rather than slowing down the requests), how many are sent in one
+// request, and how often the queue is flushed.
+const (
+	exportQueueSize     = 2048
+	exportBatchSize     = 512
+	exportFlushInterval = 5 * time.Second
+)
+
+// Exporter sends the spans in batches to an OpenTelemetry collector, using the OTLP
+// protocol over HTTP with JSON encoding. This is supported by the OpenTelemetry
+// Collector, Jaeger and most tracing backends, and is simple enough that the exporter
+// can be tested with anything which accepts HTTP requests.
+type Exporter struct {
+	url     string
+	headers map[string]string
+	service string
+	version string
+	client  *http.Client
+	onError func(error)
+
+	spans    chan *Span
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Returns a new Exporter which sends spans to the collector at the endpoint (e.g.
+// "http://localhost:4318"), with the given extra headers on each request (e.g. for
+// authentication). The service name and version identify this application in the
+// traces. Errors sending spans are passed to the onError function.
+func NewExporter(endpoint string, headers map[string]string, service, version string, onError func(error)) *Exporter {
+	e := &Exporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: headers,
+		service: service,
+		version: version,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		onError: onError,
+		spans:   make(chan *Span, exportQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e
+}
+
+// Queues the span for export, dropping it if the queue is full.
+func (e *Exporter) export(span *Span) {
+	if e == nil {
+		return
+	}
+
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Sends the queued spans whenever there are enough for a batch, or the flush interval
+// has passed, until Shutdown() is called.
+func (e *Exporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(exportFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+
+	flush := func() {
+		if len(batch) > 0 {
+			err := e.send(batch)
+			if err != nil && e.onError != nil {
+				e.onError(err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) == exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			// Send whatever is left in the queue before returning.
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+					if len(batch) == exportBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Sends the remaining spans and stops the exporter, waiting until it has finished or
+// the context is done.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+
+	e.stopOnce.Do(func() { close(e.done) })
+
+	finished := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The OTLP JSON encoding. IDs are hex-encoded, and 64-bit integers (including the
+// timestamps, in nanoseconds) are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+// The OTLP status codes.
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func (e *Exporter) send(spans []*Span) error {
+	scopeSpans := otlpScopeSpans{
+		Scope: otlpScope{Name: e.service},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+
+	for _, span := range spans {
+		span.mu.Lock()
+
+		s := otlpSpan{
+			TraceID:           span.sc.TraceID.String(),
+			SpanID:            span.sc.SpanID.String(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.attributes),
+			Status:            otlpStatus{Code: otlpStatusUnset},
+		}
+
+		if span.parentID != (SpanID{}) {
+			s.ParentSpanID = span.parentID.String()
+		}
+
+		if span.failed {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.message}
+		}
+
+		span.mu.Unlock()
+
+		scopeSpans.Spans = append(scopeSpans.Spans, s)
+	}
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: otlpAttributes([]Attribute{
+					String("service.name", e.service),
+					String("service.version", e.version),
+				}),
+			},
+			ScopeSpans: []otlpScopeSpans{scopeSpans},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("trace collector responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func otlpAttributes(attributes []Attribute) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(attributes))
+
+	for _, a := range attributes {
+		var value map[string]any
+
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+
+		result = append(result, otlpAttribute{Key: a.Key, Value: value})
+	}
+
+	return result
+}
@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// The traceparent header from the W3C Trace Context specification, which has the form
+// "<version>-<trace-id>-<parent-id>-<flags>", e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+const traceparentHeader = "traceparent"
+
+// Returns a copy of the context containing the remote span from the traceparent header,
+// if there is a valid one, so that the spans started from the context continue the
+// caller's trace. Otherwise the context is returned unchanged.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteContextKey{}, sc)
+}
+
+// Sets the traceparent header for the span in the context, so that the receiver of a
+// request can continue the trace. It does nothing if there is no span.
+func Inject(ctx context.Context, header http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+
+	flags := "00"
+	if span.sc.Sampled {
+		flags = "01"
+	}
+
+	header.Set(traceparentHeader, "00-"+span.sc.TraceID.String()+"-"+span.sc.SpanID.String()+"-"+flags)
+}
+
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+
+	// Version ff is invalid. Version 00 has exactly four parts, but future versions may
+	// add more, which we ignore.
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	if !decodeHex(traceID, sc.TraceID[:]) || !decodeHex(spanID, sc.SpanID[:]) {
+		return sc, false
+	}
+
+	var flagBytes [1]byte
+	if !decodeHex(flags, flagBytes[:]) {
+		return sc, false
+	}
+	sc.Sampled = flagBytes[0]&0x01 == 0x01
+
+	return sc, sc.isValid()
+}
+
+// Decodes the lower-case hex string into dst, which it must exactly fill.
+func decodeHex(s string, dst []byte) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
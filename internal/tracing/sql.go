@@ -0,0 +1,206 @@
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Returns a driver.Connector which wraps the given one, creating a span for each query
+// and transaction made through it, so long as the context passed to the query already
+// contains a span. The connector is used with sql.OpenDB().
+func WrapConnector(connector driver.Connector, tracer *Tracer) driver.Connector {
+	if tracer == nil {
+		return connector
+	}
+
+	return &tracedConnector{Connector: connector, tracer: tracer}
+}
+
+type tracedConnector struct {
+	driver.Connector
+	tracer *Tracer
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedConn{Conn: conn, tracer: c.tracer}, nil
+}
+
+// tracedConn wraps a driver connection. The optional interfaces that it implements are
+// passed through to the underlying connection if that implements them, and otherwise
+// fall back to the same behavior as database/sql. Between them they cover all of the
+// optional connection interfaces in database/sql/driver, so that wrapping a connection
+// doesn't hide anything that it supports.
+type tracedConn struct {
+	driver.Conn
+	tracer *Tracer
+}
+
+// Check that tracedConn implements the optional interfaces.
+var (
+	_ driver.QueryerContext     = (*tracedConn)(nil)
+	_ driver.ExecerContext      = (*tracedConn)(nil)
+	_ driver.ConnBeginTx        = (*tracedConn)(nil)
+	_ driver.ConnPrepareContext = (*tracedConn)(nil)
+	_ driver.Pinger             = (*tracedConn)(nil)
+	_ driver.SessionResetter    = (*tracedConn)(nil)
+	_ driver.Validator          = (*tracedConn)(nil)
+	_ driver.NamedValueChecker  = (*tracedConn)(nil)
+)
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	_, span := c.startSpan(ctx, query)
+	defer span.End()
+
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		span.RecordError(err)
+	}
+
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	_, span := c.startSpan(ctx, query)
+	defer span.End()
+
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		span.RecordError(err)
+	}
+
+	return result, err
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	_, span := c.startSpan(ctx, "BEGIN")
+	defer span.End()
+
+	var tx driver.Tx
+	var err error
+
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+
+	span.RecordError(err)
+	return tx, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// Returning driver.ErrSkip makes database/sql convert the value as it would have done
+// for a connection which doesn't implement driver.NamedValueChecker.
+func (c *tracedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// Starts a span for the query, named after the function which made it (see spanName()),
+// with its operation (e.g. SELECT) and the query itself (whose values are placeholders)
+// as attributes.
+func (c *tracedConn) startSpan(ctx context.Context, query string) (context.Context, *Span) {
+	// Like StartChild(), do nothing unless the context contains a span, so that we
+	// don't walk the call stack for a name which won't be used.
+	if SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+
+	statement := strings.Join(strings.Fields(query), " ")
+
+	operation, _, _ := strings.Cut(statement, " ")
+	operation = strings.ToUpper(operation)
+
+	return c.tracer.StartChild(ctx, spanName(operation), KindClient,
+		String("db.system", "postgresql"),
+		String("db.operation", operation),
+		String("db.statement", statement),
+	)
+}
+
+// The import path of this package, for skipping its frames in spanName().
+var packagePath = reflect.TypeFor[tracedConn]().PkgPath()
+
+// Matches the suffix that the Go runtime gives the names of closures, e.g. ".func1".
+var closureSuffixRX = regexp.MustCompile(`(\.func\d+)+$`)
+
+// Returns the name for the span of a query or transaction: the name of the function
+// which made it, without its package, such as "MovieModel.GetAll". This is the first
+// function on the call stack outside of database/sql and this package. The operation
+// is used instead if there is no such function.
+func spanName(operation string) string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+
+		name := frame.Function
+		switch {
+		case name == "":
+		case strings.HasPrefix(name, "database/sql."), strings.HasPrefix(name, "runtime."):
+		case strings.HasPrefix(name, packagePath+"."):
+		default:
+			// Strip the package path, which ends at the first dot after the last slash.
+			name = name[strings.LastIndex(name, "/")+1:]
+			if _, rest, found := strings.Cut(name, "."); found {
+				name = rest
+			}
+			return closureSuffixRX.ReplaceAllString(name, "")
+		}
+
+		if !more {
+			return operation
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package tracing_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"greenlight.mazavrbazavr.ru/internal/tracing"
+)
+
+// A fake driver connection, which implements driver.ExecerContext and driver.Validator
+// on top of the required methods.
+type fakeConn struct{}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+// IsValid reports the connection as broken, so that database/sql discards it after
+// every use and has to connect again.
+func (c *fakeConn) IsValid() bool {
+	return false
+}
+
+type fakeConnector struct {
+	mu       sync.Mutex
+	connects int
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connects++
+	return &fakeConn{}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver { return nil }
+
+// A stand-in for one of the models, whose methods should name the query spans.
+type movieModel struct {
+	db *sql.DB
+}
+
+func (m movieModel) Delete(ctx context.Context, id int64) error {
+	_, err := m.db.ExecContext(ctx, "DELETE FROM movies WHERE id = $1", id)
+	return err
+}
+
+func TestQuerySpans(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						Name string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+
+		js, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(js, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					names = append(names, span.Name)
+				}
+			}
+		}
+	}))
+	defer ts.Close()
+
+	exporter := tracing.NewExporter(ts.URL, nil, "greenlight", "test", func(err error) {
+		t.Errorf("exporting spans: %v", err)
+	})
+	tracer := tracing.New(exporter, 1)
+
+	connector := &fakeConnector{}
+
+	db := sql.OpenDB(tracing.WrapConnector(connector, tracer))
+	defer db.Close()
+
+	ctx, span := tracer.Start(context.Background(), "GET /v1/movies/:id", tracing.KindServer)
+
+	movies := movieModel{db: db}
+
+	for range 2 {
+		err := movies.Delete(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queries made without a span in the context aren't traced.
+	err := movies.Delete(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	span.End()
+
+	err = exporter.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{"movieModel.Delete", "movieModel.Delete", "GET /v1/movies/:id"}
+
+	if len(names) != len(want) {
+		t.Fatalf("got spans %q; want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("got span %d named %q; want %q", i, names[i], want[i])
+		}
+	}
+
+	// As the connection reports itself as invalid through the wrapper, every query
+	// needs a new one.
+	if connector.connects != 3 {
+		t.Errorf("got %d connections; want 3 (driver.Validator not passed through?)", connector.connects)
+	}
+}
@@ -0,0 +1,236 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// TraceID and SpanID identify a trace, and a span within a trace, as in the W3C Trace
+// Context specification.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanKind describes the relationship between a span and its parent and children, with
+// the same values as the OpenTelemetry protocol.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// SpanContext holds the part of a span which is propagated to its children, including
+// those in other services (through the traceparent header).
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) isValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Attribute is a key-value pair describing a span. The value must be a string, bool,
+// int, int64 or float64.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute    { return Attribute{key, value} }
+func Int(key string, value int) Attribute   { return Attribute{key, int64(value)} }
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// Span is a timed operation within a trace. All the methods of a nil *Span are no-ops,
+// so code which creates spans doesn't need to check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     SpanKind
+	sc       SpanContext
+	parentID SpanID
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	failed     bool
+	message    string
+	ended      bool
+}
+
+// Returns the span's context.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// Changes the name of the span, which is useful when it is only known once the
+// operation has finished (e.g. the route which handled a request).
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.name = name
+}
+
+// Adds attributes to the span.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// Marks the span as failed, with the error message as its status message. A nil error
+// is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed = true
+	s.message = err.Error()
+}
+
+// Ends the span and, if it is sampled, passes it to the exporter. Only the first call
+// has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.exporter.export(s)
+	}
+}
+
+// Tracer creates the spans and passes the sampled ones to an exporter. A nil *Tracer
+// is valid and creates no spans, which is how tracing is disabled.
+type Tracer struct {
+	exporter    *Exporter
+	sampleRatio float64
+}
+
+// Returns a new Tracer which samples the given ratio (from 0 to 1) of the traces which
+// start here. Traces which were started by a caller are sampled if the caller sampled
+// them, so that traces are either complete or not recorded at all.
+func New(exporter *Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{exporter: exporter, sampleRatio: sampleRatio}
+}
+
+type spanContextKey struct{}
+type remoteContextKey struct{}
+
+// Returns the span in the context, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Returns the context of the parent for a new span: the span in the context if there
+// is one, otherwise the remote span extracted from a traceparent header.
+func parentFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.sc, true
+	}
+
+	sc, ok := ctx.Value(remoteContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Starts a new span, which is a child of the span in the context (if any), and returns
+// it along with a copy of the context containing it. If the tracer is nil, the context
+// is returned unchanged with a nil span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attributes,
+	}
+
+	if parent, ok := parentFromContext(ctx); ok {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parentID = parent.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = t.sample(span.sc.TraceID)
+	}
+
+	rand.Read(span.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Starts a new span only if the context already contains one. This is used for the
+// database queries, so that the queries made by the background workers, which aren't
+// part of any request, don't each create a trace of their own.
+func (t *Tracer) StartChild(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, *Span) {
+	if SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+
+	return t.Start(ctx, name, kind, attributes...)
+}
+
+// Decides whether to sample a new trace, based on the last 8 bytes of its ID (which are
+// random), so that the decision is the same wherever it is made.
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.sampleRatio >= 1:
+		return true
+	case t.sampleRatio <= 0:
+		return false
+	default:
+		return binary.BigEndian.Uint64(id[8:])>>11 < uint64(t.sampleRatio*(1<<53))
+	}
+}
+
+// Exports the spans which have ended but haven't been sent yet, and stops the exporter.
+// Spans which end afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
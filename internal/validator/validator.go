@@ -11,6 +11,10 @@ var (
 	EmailRX = regexp.MustCompile(
 		"^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$",
 	)
+
+	// A regular expression for locales, i.e. a language code with an optional region,
+	// like "en" or "pt-BR".
+	LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
 )
 
 // A Validator type which contains a map of validation errors.
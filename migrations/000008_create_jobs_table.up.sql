@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    kind text NOT NULL,
+    payload jsonb NOT NULL DEFAULT '{}',
+    status text NOT NULL DEFAULT 'queued',
+    progress integer NOT NULL DEFAULT 0,
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL DEFAULT 5,
+    run_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    result jsonb,
+    last_error text
+);
+
+CREATE INDEX IF NOT EXISTS jobs_run_at_idx ON jobs (run_at) WHERE status IN ('queued', 'running');
\ No newline at end of file
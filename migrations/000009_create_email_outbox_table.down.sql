@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code IN ('admin:read', 'admin:write');
+
+DROP TABLE IF EXISTS email_outbox;
\ No newline at end of file
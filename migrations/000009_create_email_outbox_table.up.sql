@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    template text NOT NULL,
+    data jsonb NOT NULL DEFAULT '{}',
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_error text,
+    sent_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_next_attempt_at_idx ON email_outbox (next_attempt_at) WHERE status IN ('pending', 'sending');
+
+-- Add the permissions for the administrative endpoints.
+INSERT INTO
+    permissions (code)
+VALUES
+    ('admin:read'),
+    ('admin:write');
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
+
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
\ No newline at end of file
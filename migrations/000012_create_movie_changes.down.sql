@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS movies_notify_change ON movies;
+
+DROP FUNCTION IF EXISTS movies_notify_change();
+
+DROP TABLE IF EXISTS movie_changes;
\ No newline at end of file
@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS movie_changes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    movie_id bigint NOT NULL,
+    movie jsonb
+);
+
+CREATE INDEX IF NOT EXISTS movie_changes_created_at_idx ON movie_changes (created_at);
+
+-- Record every change to the movies table in the movie_changes log, and notify the
+-- listeners on the movie_changes channel with the ID of the change. Only the ID is sent,
+-- as notification payloads are limited to 8000 bytes; the listeners read the change
+-- itself from the log.
+CREATE OR REPLACE FUNCTION movies_notify_change() RETURNS trigger AS $$
+DECLARE
+    change_id bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO movie_changes (event, movie_id)
+        VALUES ('movie.deleted', OLD.id)
+        RETURNING id INTO change_id;
+    ELSE
+        INSERT INTO movie_changes (event, movie_id, movie)
+        VALUES (CASE TG_OP WHEN 'INSERT' THEN 'movie.created' ELSE 'movie.updated' END, NEW.id, to_jsonb(NEW))
+        RETURNING id INTO change_id;
+    END IF;
+
+    PERFORM pg_notify('movie_changes', change_id::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION movies_notify_change();
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS movie_changes_unsequenced_idx;
+
+DROP INDEX IF EXISTS movie_changes_position_idx;
+
+ALTER TABLE movie_changes DROP COLUMN IF EXISTS position;
\ No newline at end of file
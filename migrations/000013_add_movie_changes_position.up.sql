@@ -0,0 +1,13 @@
+-- The changes are streamed in the order of their position in the log, which is only
+-- assigned once the transaction which made the change has committed (see
+-- MovieModel.SequenceChanges()). The IDs can't be used for this, as they are assigned
+-- when the change is made: a long transaction can commit a change with a lower ID after
+-- a change with a higher ID has already been streamed. The existing changes get their
+-- IDs as their positions, so that the event IDs which clients already have stay valid.
+ALTER TABLE movie_changes ADD COLUMN IF NOT EXISTS position bigint;
+
+UPDATE movie_changes SET position = id WHERE position IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_changes_position_idx ON movie_changes (position);
+
+CREATE INDEX IF NOT EXISTS movie_changes_unsequenced_idx ON movie_changes (id) WHERE position IS NULL;
\ No newline at end of file
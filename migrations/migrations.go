@@ -0,0 +1,9 @@
+package migrations
+
+import "embed"
+
+// FS holds the SQL migration files, which are embedded in the binary so that it can
+// migrate the database itself (see the "migrate" subcommand of cmd/api).
+//
+//go:embed *.sql
+var FS embed.FS